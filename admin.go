@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sburnett/encore/store"
+	"github.com/sburnett/encore/tasktemplate"
+)
+
+// The admin API manages task functions and the scheduler without SQL access
+// to the database. Every request must carry "Authorization: Bearer <token>",
+// where the token is the value of -admin_token.
+//
+//     GET  /admin/task_functions               list task functions
+//     POST /admin/task_functions               create a task function
+//     POST /admin/task_functions/<id>          change some fields of one
+//     POST /admin/task_functions/<id>/enable   enable one
+//     POST /admin/task_functions/<id>/disable  disable one
+//     GET  /admin/scheduler                    show concurrent_functions
+//     POST /admin/scheduler                    change concurrent_functions
+//     GET  /admin/schedules                    list schedules and their budgets
+//     POST /admin/task_templates/reload        reload task templates
+//     GET  /admin/sites                        list registered sites
+//     POST /admin/sites                        register a site
+//     POST /admin/sites/<id>                   change some fields of one
+//
+// Request and response bodies are JSON, with the same field names as
+// store.TaskFunction, store.Schedule and store.Site. Servers pick up changes
+// to the rate, weight and countries of scheduled task functions, and stop
+// serving disabled ones, within -served_flush_interval; the scheduler then
+// frees their slots. Priorities and budgets apply to schedules made after the
+// change. Task function names are folded to lower case. New sites get a
+// random Key unless they bring their own.
+
+var adminRequests = metrics.GetOrRegisterCounter("AdminRequests", nil)
+var adminUnauthorized = metrics.GetOrRegisterCounter("AdminUnauthorized", nil)
+var adminErrors = metrics.GetOrRegisterCounter("AdminError", nil)
+
+var taskFunctionNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+type adminState struct {
+	Store     store.Store
+	Token     string
+	Templates templateReloader
+	Sites     *siteRegistry
+}
+
+type templateReloader interface {
+	ReloadTemplates() error
+}
+
+// taskFunctionChanges is the body of an update. Only fields that are present
+// change.
+type taskFunctionChanges struct {
+	Name               *string
+	Priority           *int
+	MaxDurationSeconds *int
+	MaxMeasurements    *int
+	MaxRatePerSecond   *int
+	Weight             *int
+	Enabled            *bool
+	IncludeCountries   *[]string
+	ExcludeCountries   *[]string
+	CountryQuotas      *map[string]int
+}
+
+// siteChanges is the body of a site update. Only fields that are present
+// change.
+type siteChanges struct {
+	Key              *string
+	Name             *string
+	ContactEmail     *string
+	AllowedTaskTypes *[]string
+	ShowStats        *bool
+	Enabled          *bool
+	Runtime          *string
+}
+
+type schedulerConfiguration struct {
+	ConcurrentFunctions int
+}
+
+func NewAdminServer(s store.Store, token string, templates templateReloader, sites *siteRegistry) http.Handler {
+	return &adminState{
+		Store:     s,
+		Token:     token,
+		Templates: templates,
+		Sites:     sites,
+	}
+}
+
+func (state *adminState) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, prefix) {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, prefix)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(state.Token)) == 1
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("error encoding JSON response: %v", err)
+	}
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	adminErrors.Inc(1)
+	writeJson(w, status, struct {
+		Error string
+	}{
+		Error: err.Error(),
+	})
+}
+
+func (state *adminState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	adminRequests.Inc(1)
+
+	if !state.authorized(r) {
+		adminUnauthorized.Inc(1)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="encore admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/")
+	components := strings.Split(path, "/")
+	switch {
+	case path == "task_functions" && r.Method == "GET":
+		state.listTaskFunctions(w)
+	case path == "task_functions" && r.Method == "POST":
+		state.createTaskFunction(w, r)
+	case len(components) == 2 && components[0] == "task_functions" && r.Method == "POST":
+		state.updateTaskFunction(w, r, components[1], nil)
+	case len(components) == 3 && components[0] == "task_functions" && components[2] == "enable" && r.Method == "POST":
+		enabled := true
+		state.updateTaskFunction(w, r, components[1], &taskFunctionChanges{Enabled: &enabled})
+	case len(components) == 3 && components[0] == "task_functions" && components[2] == "disable" && r.Method == "POST":
+		enabled := false
+		state.updateTaskFunction(w, r, components[1], &taskFunctionChanges{Enabled: &enabled})
+	case path == "scheduler" && r.Method == "GET":
+		state.showScheduler(w)
+	case path == "scheduler" && r.Method == "POST":
+		state.configureScheduler(w, r)
+	case path == "schedules" && r.Method == "GET":
+		state.listSchedules(w)
+	case path == "task_templates/reload" && r.Method == "POST":
+		state.reloadTemplates(w)
+	case path == "sites" && r.Method == "GET":
+		state.listSites(w)
+	case path == "sites" && r.Method == "POST":
+		state.createSite(w, r)
+	case len(components) == 2 && components[0] == "sites" && r.Method == "POST":
+		state.updateSite(w, r, components[1])
+	default:
+		adminError(w, http.StatusNotFound, fmt.Errorf("no such admin endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (state *adminState) listTaskFunctions(w http.ResponseWriter) {
+	taskFunctions, err := state.Store.TaskFunctions()
+	if err != nil {
+		log.Printf("error listing task functions: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if taskFunctions == nil {
+		taskFunctions = []store.TaskFunction{}
+	}
+	writeJson(w, http.StatusOK, taskFunctions)
+}
+
+func validateTaskFunction(taskFunction store.TaskFunction) error {
+	if taskFunction.Name == "" {
+		return fmt.Errorf("task function needs a Name")
+	}
+	if !taskFunctionNameRegexp.MatchString(taskFunction.Name) {
+		return fmt.Errorf("Name must be letters, digits and underscores, starting with a letter or underscore")
+	}
+	if taskFunction.MaxDurationSeconds < 0 || taskFunction.MaxMeasurements < 0 || taskFunction.MaxRatePerSecond < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	if taskFunction.Weight < 1 {
+		return fmt.Errorf("Weight must be at least 1")
+	}
+	for country, measurements := range taskFunction.CountryQuotas {
+		if measurements < 0 {
+			return fmt.Errorf("quota for %s can't be negative", country)
+		}
+	}
+	return nil
+}
+
+func (state *adminState) createTaskFunction(w http.ResponseWriter, r *http.Request) {
+	taskFunction := store.TaskFunction{
+		Weight: 1,
+	}
+	if err := json.NewDecoder(r.Body).Decode(&taskFunction); err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("error decoding task function: %v", err))
+		return
+	}
+	taskFunction.Id = 0
+	taskFunction.Name = store.NormalizeTaskFunctionName(taskFunction.Name)
+	if err := validateTaskFunction(taskFunction); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, err := state.Store.CreateTaskFunction(taskFunction)
+	if err != nil {
+		log.Printf("error creating task function: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	taskFunction.Id = id
+	log.Printf("admin created task function %d (%s)", id, taskFunction.Name)
+	writeJson(w, http.StatusCreated, taskFunction)
+}
+
+// updateTaskFunction applies changes to a task function, decoding them from
+// the request body if changes is nil.
+func (state *adminState) updateTaskFunction(w http.ResponseWriter, r *http.Request, idString string, changes *taskFunctionChanges) {
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("invalid task function id %q", idString))
+		return
+	}
+	if changes == nil {
+		changes = &taskFunctionChanges{}
+		if err := json.NewDecoder(r.Body).Decode(changes); err != nil {
+			adminError(w, http.StatusBadRequest, fmt.Errorf("error decoding changes: %v", err))
+			return
+		}
+	}
+
+	taskFunctions, err := state.Store.TaskFunctions()
+	if err != nil {
+		log.Printf("error listing task functions: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var taskFunction *store.TaskFunction
+	for i := range taskFunctions {
+		if taskFunctions[i].Id == id {
+			taskFunction = &taskFunctions[i]
+		}
+	}
+	if taskFunction == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no task function %d", id))
+		return
+	}
+
+	if changes.Name != nil {
+		taskFunction.Name = store.NormalizeTaskFunctionName(*changes.Name)
+	}
+	if changes.Priority != nil {
+		taskFunction.Priority = *changes.Priority
+	}
+	if changes.MaxDurationSeconds != nil {
+		taskFunction.MaxDurationSeconds = *changes.MaxDurationSeconds
+	}
+	if changes.MaxMeasurements != nil {
+		taskFunction.MaxMeasurements = *changes.MaxMeasurements
+	}
+	if changes.MaxRatePerSecond != nil {
+		taskFunction.MaxRatePerSecond = *changes.MaxRatePerSecond
+	}
+	if changes.Weight != nil {
+		taskFunction.Weight = *changes.Weight
+	}
+	if changes.Enabled != nil {
+		taskFunction.Enabled = *changes.Enabled
+	}
+	if changes.IncludeCountries != nil {
+		taskFunction.IncludeCountries = *changes.IncludeCountries
+	}
+	if changes.ExcludeCountries != nil {
+		taskFunction.ExcludeCountries = *changes.ExcludeCountries
+	}
+	if changes.CountryQuotas != nil {
+		taskFunction.CountryQuotas = *changes.CountryQuotas
+	}
+	if err := validateTaskFunction(*taskFunction); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := state.Store.UpdateTaskFunction(*taskFunction); err == sql.ErrNoRows {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no task function %d", id))
+		return
+	} else if err != nil {
+		log.Printf("error updating task function %d: %v", id, err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("admin updated task function %d (%s)", id, taskFunction.Name)
+	writeJson(w, http.StatusOK, taskFunction)
+}
+
+func (state *adminState) showScheduler(w http.ResponseWriter) {
+	concurrentFunctions, err := state.Store.ConcurrentFunctions()
+	if err != nil {
+		log.Printf("error reading scheduler configuration: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, schedulerConfiguration{
+		ConcurrentFunctions: concurrentFunctions,
+	})
+}
+
+func (state *adminState) configureScheduler(w http.ResponseWriter, r *http.Request) {
+	var configuration schedulerConfiguration
+	if err := json.NewDecoder(r.Body).Decode(&configuration); err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("error decoding scheduler configuration: %v", err))
+		return
+	}
+	if configuration.ConcurrentFunctions < 0 {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("ConcurrentFunctions can't be negative"))
+		return
+	}
+	if err := state.Store.SetConcurrentFunctions(configuration.ConcurrentFunctions); err != nil {
+		log.Printf("error updating scheduler configuration: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("admin set concurrent functions to %d", configuration.ConcurrentFunctions)
+	writeJson(w, http.StatusOK, configuration)
+}
+
+func (state *adminState) listSchedules(w http.ResponseWriter) {
+	schedules, err := state.Store.Schedules()
+	if err != nil {
+		log.Printf("error listing schedules: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if schedules == nil {
+		schedules = []store.Schedule{}
+	}
+	writeJson(w, http.StatusOK, schedules)
+}
+
+func (state *adminState) reloadTemplates(w http.ResponseWriter) {
+	if err := state.Templates.ReloadTemplates(); err != nil {
+		adminError(w, http.StatusUnprocessableEntity, fmt.Errorf("kept the previous task templates: %v", err))
+		return
+	}
+	log.Printf("admin reloaded task templates")
+	writeJson(w, http.StatusOK, struct {
+		Reloaded bool
+	}{
+		Reloaded: true,
+	})
+}
+
+func (state *adminState) listSites(w http.ResponseWriter) {
+	sites, err := state.Store.Sites()
+	if err != nil {
+		log.Printf("error listing sites: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if sites == nil {
+		sites = []store.Site{}
+	}
+	writeJson(w, http.StatusOK, sites)
+}
+
+func validateSite(site store.Site) error {
+	if site.Key == "" {
+		return fmt.Errorf("site needs a Key")
+	}
+	if site.Name == "" {
+		return fmt.Errorf("site needs a Name")
+	}
+	if site.ContactEmail != "" {
+		if _, err := mail.ParseAddress(site.ContactEmail); err != nil {
+			return fmt.Errorf("invalid ContactEmail: %v", err)
+		}
+	}
+	if !tasktemplate.ValidRuntime(site.Runtime) {
+		return fmt.Errorf("invalid Runtime %q; use one of %s", site.Runtime, strings.Join(tasktemplate.Runtimes, ", "))
+	}
+	return nil
+}
+
+// refreshSites makes site changes take effect on this instance right away.
+// Other instances see them within -sites_refresh_interval.
+func (state *adminState) refreshSites() {
+	if err := state.Sites.Refresh(); err != nil {
+		log.Printf("error refreshing sites: %v", err)
+		siteRefreshErrorCount.Inc(1)
+	}
+}
+
+func (state *adminState) createSite(w http.ResponseWriter, r *http.Request) {
+	site := store.Site{
+		Enabled: true,
+	}
+	if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("error decoding site: %v", err))
+		return
+	}
+	site.Id = 0
+	if site.Key == "" {
+		key, err := newSiteKey()
+		if err != nil {
+			log.Printf("error generating site key: %v", err)
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		site.Key = key
+	}
+	if err := validateSite(site); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, err := state.Store.CreateSite(site)
+	if err != nil {
+		log.Printf("error creating site: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	site.Id = id
+	state.refreshSites()
+	log.Printf("admin registered site %d (%s)", id, site.Name)
+	writeJson(w, http.StatusCreated, site)
+}
+
+func (state *adminState) updateSite(w http.ResponseWriter, r *http.Request, idString string) {
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("invalid site id %q", idString))
+		return
+	}
+	var changes siteChanges
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("error decoding changes: %v", err))
+		return
+	}
+
+	sites, err := state.Store.Sites()
+	if err != nil {
+		log.Printf("error listing sites: %v", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var site *store.Site
+	for i := range sites {
+		if sites[i].Id == id {
+			site = &sites[i]
+		}
+	}
+	if site == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no site %d", id))
+		return
+	}
+
+	if changes.Key != nil {
+		site.Key = *changes.Key
+	}
+	if changes.Name != nil {
+		site.Name = *changes.Name
+	}
+	if changes.ContactEmail != nil {
+		site.ContactEmail = *changes.ContactEmail
+	}
+	if changes.AllowedTaskTypes != nil {
+		site.AllowedTaskTypes = *changes.AllowedTaskTypes
+	}
+	if changes.ShowStats != nil {
+		site.ShowStats = *changes.ShowStats
+	}
+	if changes.Enabled != nil {
+		site.Enabled = *changes.Enabled
+	}
+	if changes.Runtime != nil {
+		site.Runtime = *changes.Runtime
+	}
+	if err := validateSite(*site); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := state.Store.UpdateSite(*site); err == sql.ErrNoRows {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no site %d", id))
+		return
+	} else if err != nil {
+		log.Printf("error updating site %d: %v", id, err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	state.refreshSites()
+	log.Printf("admin updated site %d (%s)", id, site.Name)
+	writeJson(w, http.StatusOK, site)
+}
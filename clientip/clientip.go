@@ -0,0 +1,163 @@
+// Package clientip finds the address of the client behind the reverse proxies
+// in front of Encore.
+//
+// We only believe forwarding headers on requests that come from a trusted
+// proxy, and we only read the one header that our proxies set, because
+// proxies pass along any other forwarding headers that clients make up. When
+// a header lists several addresses, the client is the rightmost address that
+// isn't a trusted proxy.
+package clientip
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	XRealIp       = "X-Real-Ip"
+	XForwardedFor = "X-Forwarded-For"
+	Forwarded     = "Forwarded"
+)
+
+var trustedProxies = flag.String("trusted_proxies", "127.0.0.0/8,::1/128", "Comma separated CIDRs of reverse proxies whose forwarding headers we believe.")
+var clientIpHeader = flag.String("client_ip_header", XRealIp, "Header that trusted proxies put the client address in: X-Real-Ip, X-Forwarded-For or Forwarded.")
+
+type Resolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// NewResolver trusts proxies in the comma separated CIDRs, which may also be
+// single addresses, to set header.
+func NewResolver(cidrs, header string) (*Resolver, error) {
+	header = http.CanonicalHeaderKey(header)
+	switch header {
+	case XRealIp, XForwardedFor, Forwarded:
+	default:
+		return nil, fmt.Errorf("unsupported client IP header %q", header)
+	}
+
+	resolver := &Resolver{
+		header: header,
+	}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+	return resolver, nil
+}
+
+// FromFlags makes a Resolver from -trusted_proxies and -client_ip_header.
+func FromFlags() *Resolver {
+	resolver, err := NewResolver(*trustedProxies, *clientIpHeader)
+	if err != nil {
+		log.Fatalf("error configuring client IP resolution: %v", err)
+	}
+	return resolver
+}
+
+func (resolver *Resolver) trusts(ip net.IP) bool {
+	for _, network := range resolver.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddress parses an address with or without a port, and IPv6 addresses
+// in brackets.
+func parseAddress(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return net.ParseIP(address)
+}
+
+// parseForwarded returns the for= addresses of RFC 7239 Forwarded headers, in
+// order. Obfuscated and unknown addresses are nil.
+func parseForwarded(values []string) []net.IP {
+	var addresses []net.IP
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				fields := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(fields) != 2 || !strings.EqualFold(fields[0], "for") {
+					continue
+				}
+				addresses = append(addresses, parseAddress(strings.Trim(fields[1], `"`)))
+			}
+		}
+	}
+	return addresses
+}
+
+func (resolver *Resolver) forwardedAddresses(header http.Header) []net.IP {
+	var addresses []net.IP
+	switch resolver.header {
+	case Forwarded:
+		addresses = parseForwarded(header[Forwarded])
+	case XForwardedFor:
+		for _, value := range header[XForwardedFor] {
+			for _, address := range strings.Split(value, ",") {
+				addresses = append(addresses, parseAddress(address))
+			}
+		}
+	case XRealIp:
+		if value := header.Get(XRealIp); value != "" {
+			addresses = append(addresses, parseAddress(value))
+		}
+	}
+	return addresses
+}
+
+// ClientIp returns the address of the client that made a request which
+// reached us from remoteAddr, or nil if remoteAddr isn't an address.
+func (resolver *Resolver) ClientIp(remoteAddr string, header http.Header) net.IP {
+	client := parseAddress(remoteAddr)
+	if client == nil || !resolver.trusts(client) {
+		return client
+	}
+	addresses := resolver.forwardedAddresses(header)
+	for i := len(addresses) - 1; i >= 0; i-- {
+		// If a proxy we trust couldn't tell who its client was, neither
+		// can we, and addresses further left are up to the client.
+		if addresses[i] == nil {
+			return client
+		}
+		client = addresses[i]
+		if !resolver.trusts(client) {
+			return client
+		}
+	}
+	return client
+}
+
+// RequestClientIp is ClientIp for a request we're serving.
+func (resolver *Resolver) RequestClientIp(r *http.Request) net.IP {
+	return resolver.ClientIp(r.RemoteAddr, r.Header)
+}
@@ -0,0 +1,96 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClientIp(t *testing.T) {
+	const trusted = "127.0.0.0/8,::1/128,10.0.0.0/8,192.0.2.10"
+	for _, test := range []struct {
+		name       string
+		header     string
+		remoteAddr string
+		values     map[string][]string
+		want       string
+	}{
+		{"no header", XForwardedFor, "127.0.0.1:1234", nil, "127.0.0.1"},
+		{"untrusted remote addr", XForwardedFor, "203.0.113.5:1234", map[string][]string{XForwardedFor: {"198.51.100.7"}}, "203.0.113.5"},
+		{"untrusted remote addr with trusted forged", XForwardedFor, "203.0.113.5:1234", map[string][]string{XForwardedFor: {"10.0.0.1"}}, "203.0.113.5"},
+		{"trusted proxy", XForwardedFor, "127.0.0.1:1234", map[string][]string{XForwardedFor: {"198.51.100.7"}}, "198.51.100.7"},
+		{"single trusted address", XForwardedFor, "192.0.2.10:1234", map[string][]string{XForwardedFor: {"198.51.100.7"}}, "198.51.100.7"},
+		{"chain of trusted proxies", XForwardedFor, "127.0.0.1:1234", map[string][]string{XForwardedFor: {"198.51.100.7, 10.0.0.2, 10.0.0.3"}}, "198.51.100.7"},
+		{"forged addresses left of the client", XForwardedFor, "127.0.0.1:1234", map[string][]string{XForwardedFor: {"6.6.6.6, 198.51.100.7, 10.0.0.2"}}, "198.51.100.7"},
+		{"chain across header lines", XForwardedFor, "127.0.0.1:1234", map[string][]string{XForwardedFor: {"6.6.6.6, 198.51.100.7", "10.0.0.2"}}, "198.51.100.7"},
+		{"only trusted proxies", XForwardedFor, "127.0.0.1:1234", map[string][]string{XForwardedFor: {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"garbage forwarded address", XForwardedFor, "127.0.0.1:1234", map[string][]string{XForwardedFor: {"not an address"}}, "127.0.0.1"},
+		{"garbage behind trusted proxy", XForwardedFor, "127.0.0.1:1234", map[string][]string{XForwardedFor: {"198.51.100.7, garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{"empty forwarded address", XForwardedFor, "127.0.0.1:1234", map[string][]string{XForwardedFor: {""}}, "127.0.0.1"},
+		{"garbage remote addr", XForwardedFor, "garbage", map[string][]string{XForwardedFor: {"198.51.100.7"}}, ""},
+		{"remote addr without port", XForwardedFor, "127.0.0.1", map[string][]string{XForwardedFor: {"198.51.100.7"}}, "198.51.100.7"},
+		{"IPv6 remote addr", XForwardedFor, "[::1]:1234", map[string][]string{XForwardedFor: {"2001:db8::1"}}, "2001:db8::1"},
+		{"untrusted IPv6 remote addr", XForwardedFor, "[2001:db8::2]:1234", map[string][]string{XForwardedFor: {"198.51.100.7"}}, "2001:db8::2"},
+		{"other headers ignored", XRealIp, "127.0.0.1:1234", map[string][]string{XForwardedFor: {"6.6.6.6"}, Forwarded: {"for=6.6.6.6"}}, "127.0.0.1"},
+		{"X-Real-Ip", XRealIp, "127.0.0.1:1234", map[string][]string{XRealIp: {"198.51.100.7"}, XForwardedFor: {"6.6.6.6"}}, "198.51.100.7"},
+		{"garbage X-Real-Ip", XRealIp, "127.0.0.1:1234", map[string][]string{XRealIp: {"198.51.100.7, 6.6.6.6"}}, "127.0.0.1"},
+		{"Forwarded", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {"for=198.51.100.7;proto=https"}}, "198.51.100.7"},
+		{"Forwarded chain", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {"for=6.6.6.6, for=198.51.100.7;by=10.0.0.2", "for=10.0.0.2"}}, "198.51.100.7"},
+		{"Forwarded case insensitive", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {"For=198.51.100.7"}}, "198.51.100.7"},
+		{"Forwarded quoted IPv6 with port", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {`for="[2001:db8::1]:80"`}}, "2001:db8::1"},
+		{"Forwarded trusted IPv6 loopback", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {`for="[::1]:80"`}}, "::1"},
+		{"Forwarded obfuscated", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {"for=6.6.6.6, for=_hidden"}}, "127.0.0.1"},
+		{"Forwarded unknown", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {"for=unknown"}}, "127.0.0.1"},
+		{"Forwarded without for", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {"proto=https;by=10.0.0.2"}}, "127.0.0.1"},
+		{"Forwarded garbage", Forwarded, "127.0.0.1:1234", map[string][]string{Forwarded: {`;;,=,for="`}}, "127.0.0.1"},
+	} {
+		resolver, err := NewResolver(trusted, test.header)
+		if err != nil {
+			t.Fatalf("%s: error creating resolver: %v", test.name, err)
+		}
+		header := http.Header{}
+		for key, values := range test.values {
+			for _, value := range values {
+				header.Add(key, value)
+			}
+		}
+		got := resolver.ClientIp(test.remoteAddr, header)
+		if test.want == "" {
+			if got != nil {
+				t.Errorf("%s: ClientIp = %v, want nil", test.name, got)
+			}
+			continue
+		}
+		if !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%s: ClientIp = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewResolverRejects(t *testing.T) {
+	for _, test := range []struct {
+		cidrs  string
+		header string
+	}{
+		{"127.0.0.1", "X-Client-Ip"},
+		{"not a cidr", XRealIp},
+		{"10.0.0.0/33", XRealIp},
+		{"127.0.0.1,garbage", XForwardedFor},
+	} {
+		if _, err := NewResolver(test.cidrs, test.header); err == nil {
+			t.Errorf("NewResolver(%q, %q) succeeded, want an error", test.cidrs, test.header)
+		}
+	}
+}
+
+func TestNewResolverCanonicalizesHeader(t *testing.T) {
+	resolver, err := NewResolver("127.0.0.1", "x-forwarded-for")
+	if err != nil {
+		t.Fatalf("error creating resolver: %v", err)
+	}
+	header := http.Header{}
+	header.Set(XForwardedFor, "198.51.100.7")
+	if got := resolver.ClientIp("127.0.0.1:1234", header); !got.Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("ClientIp = %v, want 198.51.100.7", got)
+	}
+}
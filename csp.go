@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sburnett/encore/store"
+)
+
+// Sites with a strict Content-Security-Policy embed tasks in CSP mode:
+//
+//     <script nonce="N" src="/task.js?csp=true&nonce=N"></script>
+//     <iframe src="/task.html?csp=true"></iframe>
+//
+// CSP mode uses the vanilla runtime, which doesn't inject jQuery or other
+// helper scripts. Task scripts get the page's nonce, and /task.html sends its
+// own policy with a fresh nonce for its inline script. /csp?site=KEY documents
+// the sources a registered site must allow for the tasks it may get.
+
+const cspNonceBytes = 16
+
+var cspDocsRefreshInterval = flag.Duration("csp_docs_refresh_interval", time.Hour, "Rebuild the summary of task sources that /csp serves this often. 0 builds it only at startup.")
+
+var cspPolicyCount = metrics.GetOrRegisterCounter("CspPoliciesServed", nil)
+var invalidNonceCount = metrics.GetOrRegisterCounter("InvalidCspNonce", nil)
+var nonceErrorCount = metrics.GetOrRegisterCounter("CspNonceError", nil)
+var cspDocsErrorCount = metrics.GetOrRegisterCounter("CspDocsError", nil)
+
+// cspParameterDirectives maps task parameters that name URLs, or lists of
+// URLs separated by spaces, to the directive that must allow them.
+var cspParameterDirectives = map[string]string{
+	"imageUrl":        "img-src",
+	"imageUrls":       "img-src",
+	"controlImageUrl": "img-src",
+	"scriptUrl":       "script-src",
+	"cssUrl":          "style-src",
+	"iframeUrl":       "frame-src",
+	"fetchUrl":        "connect-src",
+}
+
+// cspDirectives are the directives we generate, in the order we print them.
+var cspDirectives = []string{"script-src", "connect-src", "img-src", "style-src", "frame-src"}
+
+var nonceRegexp = regexp.MustCompile(`^[A-Za-z0-9+/_-]{8,128}={0,2}$`)
+
+func newNonce() (string, error) {
+	nonce := make([]byte, cspNonceBytes)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// pageNonce returns the nonce the embedding page passed in the "nonce" hint,
+// or "" if it didn't pass a valid one.
+func pageNonce(hints map[string]string) string {
+	nonce := hints["nonce"]
+	if nonce == "" {
+		return ""
+	}
+	if !nonceRegexp.MatchString(nonce) {
+		invalidNonceCount.Inc(1)
+		return ""
+	}
+	return nonce
+}
+
+// sourceOrigin returns the CSP source for the origin of rawUrl. Scheme-relative
+// URLs like the default -server_url of production, "//host", give a bare host,
+// which CSP matches using the scheme of the protected page, just as browsers
+// resolve the URL itself.
+func sourceOrigin(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+	if parsed.Scheme == "" {
+		return parsed.Host
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+// cspSources are the origins each directive must allow, keyed by directive.
+type cspSources map[string][]string
+
+func (sources cspSources) add(directive, rawUrl string) {
+	if origin := sourceOrigin(rawUrl); origin != "" {
+		sources.addOrigin(directive, origin)
+	}
+}
+
+func (sources cspSources) addOrigin(directive, origin string) {
+	for _, existing := range sources[directive] {
+		if existing == origin {
+			return
+		}
+	}
+	sources[directive] = append(sources[directive], origin)
+	sort.Strings(sources[directive])
+}
+
+func (sources cspSources) merge(other cspSources) {
+	for directive, origins := range other {
+		for _, origin := range origins {
+			sources.addOrigin(directive, origin)
+		}
+	}
+}
+
+// taskCspSources lists what a task loads: its targets, the task script from
+// serverUrl, and the results it submits there.
+func taskCspSources(parameters map[string]string, serverUrl string) cspSources {
+	sources := make(cspSources)
+	sources.add("script-src", serverUrl)
+	sources.add("connect-src", serverUrl)
+	for parameter, directive := range cspParameterDirectives {
+		for _, value := range strings.Fields(parameters[parameter]) {
+			sources.add(directive, value)
+		}
+	}
+	return sources
+}
+
+// Policy formats sources as a Content-Security-Policy. A non-empty nonce
+// allows scripts that carry it.
+func (sources cspSources) Policy(nonce string) string {
+	directives := []string{"default-src 'none'"}
+	for _, directive := range cspDirectives {
+		values := sources[directive]
+		if directive == "script-src" && nonce != "" {
+			values = append([]string{fmt.Sprintf("'nonce-%s'", nonce)}, values...)
+		}
+		if len(values) == 0 {
+			continue
+		}
+		directives = append(directives, directive+" "+strings.Join(values, " "))
+	}
+	return strings.Join(directives, "; ")
+}
+
+func stringParameters(task *store.Task) map[string]string {
+	parameters := make(map[string]string)
+	for k, v := range task.Parameters {
+		if v.Valid {
+			parameters[k] = v.String
+		}
+	}
+	return parameters
+}
+
+// cspDocsState serves /csp?site=KEY, which documents the sources a registered
+// site must allow for each task type it may get. It answers from a summary of
+// the tasks table that it rebuilds every -csp_docs_refresh_interval, so
+// requests never reach the store. Tasks that task functions generate may load
+// other origins.
+type cspDocsState struct {
+	ServerUrl string
+	Sites     *siteRegistry
+
+	store      store.Store
+	mutex      sync.RWMutex
+	byTaskType map[string]cspSources
+}
+
+type cspTaskTypeSources struct {
+	TaskType string
+	Sources  cspSources
+}
+
+func NewCspDocsServer(s store.Store, serverUrl string, sites *siteRegistry) http.Handler {
+	state := &cspDocsState{
+		ServerUrl: serverUrl,
+		Sites:     sites,
+		store:     s,
+	}
+	state.Refresh()
+	if *cspDocsRefreshInterval > 0 {
+		go func() {
+			for _ = range time.Tick(*cspDocsRefreshInterval) {
+				state.Refresh()
+			}
+		}()
+	}
+	return state
+}
+
+// Refresh summarizes the sources of every task by task type.
+func (state *cspDocsState) Refresh() {
+	byTaskType := make(map[string]cspSources)
+	for task := range state.store.AllTasks() {
+		parameters := stringParameters(task)
+		taskType := parameters["taskType"]
+		if byTaskType[taskType] == nil {
+			byTaskType[taskType] = make(cspSources)
+		}
+		byTaskType[taskType].merge(taskCspSources(parameters, state.ServerUrl))
+	}
+	state.mutex.Lock()
+	state.byTaskType = byTaskType
+	state.mutex.Unlock()
+}
+
+// siteSources returns the sources of the task types that site may get, in
+// order of task type.
+func (state *cspDocsState) siteSources(site store.Site) []cspTaskTypeSources {
+	allowed := make(map[string]bool)
+	for _, taskType := range site.AllowedTaskTypes {
+		allowed[taskType] = true
+	}
+
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	var taskTypes []cspTaskTypeSources
+	for taskType, sources := range state.byTaskType {
+		if len(allowed) > 0 && !allowed[taskType] {
+			continue
+		}
+		taskTypes = append(taskTypes, cspTaskTypeSources{
+			TaskType: taskType,
+			Sources:  sources,
+		})
+	}
+	sort.Sort(cspTaskTypeSourcesByType(taskTypes))
+	return taskTypes
+}
+
+type cspTaskTypeSourcesByType []cspTaskTypeSources
+
+func (s cspTaskTypeSourcesByType) Len() int           { return len(s) }
+func (s cspTaskTypeSourcesByType) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s cspTaskTypeSourcesByType) Less(i, j int) bool { return s[i].TaskType < s[j].TaskType }
+
+func (state *cspDocsState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	site, ok := state.Sites.Lookup(r.FormValue("site"))
+	if !ok {
+		http.Error(w, "pass the key of a registered site as ?site=", http.StatusNotFound)
+		cspDocsErrorCount.Inc(1)
+		return
+	}
+
+	taskTypes := state.siteSources(site)
+	all := make(cspSources)
+	for _, taskType := range taskTypes {
+		all.merge(taskType.Sources)
+	}
+
+	if wantsJson(r) {
+		writeJson(w, http.StatusOK, struct {
+			TaskTypes []cspTaskTypeSources
+			All       cspSources
+		}{
+			TaskTypes: taskTypes,
+			All:       all,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "# Content-Security-Policy sources for Encore tasks on %s.\n", site.Name)
+	fmt.Fprintf(w, "# Embed tasks with ?csp=true and pass your page's nonce as ?nonce=.\n\n")
+	for _, taskType := range taskTypes {
+		fmt.Fprintf(w, "# Task type %s\n", taskType.TaskType)
+		writeCspDirectives(w, taskType.Sources)
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "# Every task type\n")
+	writeCspDirectives(w, all)
+}
+
+func writeCspDirectives(w http.ResponseWriter, sources cspSources) {
+	for _, directive := range cspDirectives {
+		if origins := sources[directive]; len(origins) > 0 {
+			fmt.Fprintf(w, "%s %s\n", directive, strings.Join(origins, " "))
+		}
+	}
+}
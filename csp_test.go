@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sburnett/encore/store"
+)
+
+func TestSourceOrigin(t *testing.T) {
+	for _, test := range []struct {
+		url, want string
+	}{
+		{"http://example.com/a.png", "http://example.com"},
+		{"https://example.com:8443/a?b=c", "https://example.com:8443"},
+		{"//encore.example.com", "encore.example.com"},
+		{"//cdn.example.com/a.js", "cdn.example.com"},
+		{"/relative", ""},
+		{"", ""},
+		{"%", ""},
+	} {
+		if got := sourceOrigin(test.url); got != test.want {
+			t.Errorf("sourceOrigin(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestTaskCspSourcesWithSchemeRelativeServer(t *testing.T) {
+	sources := taskCspSources(map[string]string{
+		"taskType":  "img-multi",
+		"imageUrls": "http://a.example.com/1.png //b.example.com/2.png",
+	}, "//encore.example.com")
+
+	want := cspSources{
+		"script-src":  {"encore.example.com"},
+		"connect-src": {"encore.example.com"},
+		"img-src":     {"b.example.com", "http://a.example.com"},
+	}
+	if !reflect.DeepEqual(sources, want) {
+		t.Errorf("sources = %v, want %v", sources, want)
+	}
+
+	policy := sources.Policy("abc123==")
+	for _, directive := range []string{
+		"default-src 'none'",
+		"script-src 'nonce-abc123==' encore.example.com",
+		"connect-src encore.example.com",
+	} {
+		if !strings.Contains(policy, directive) {
+			t.Errorf("policy %q lacks %q", policy, directive)
+		}
+	}
+}
+
+func TestCspDocsRequireSiteKey(t *testing.T) {
+	s := store.NewMemoryStore()
+	for _, parameters := range []map[string]string{
+		{"taskType": "img", "imageUrl": "http://img.example.com/a.png"},
+		{"taskType": "script", "scriptUrl": "http://script.example.com/a.js"},
+	} {
+		task := &store.Task{Parameters: make(map[string]sql.NullString)}
+		for k, v := range parameters {
+			task.Parameters[k] = sql.NullString{String: v, Valid: true}
+		}
+		if _, err := s.InsertTasks([]*store.Task{task}); err != nil {
+			t.Fatalf("error inserting task: %v", err)
+		}
+	}
+	if _, err := s.CreateSite(store.Site{Key: "imagesonly", Name: "Images", AllowedTaskTypes: []string{"img"}, Enabled: true}); err != nil {
+		t.Fatalf("error creating site: %v", err)
+	}
+	server := NewCspDocsServer(s, "//encore.example.com", newSiteRegistry(s))
+
+	for _, path := range []string{"/csp", "/csp?site=unknown"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+		if strings.Contains(w.Body.String(), "example.com") {
+			t.Errorf("GET %s revealed task sources: %s", path, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/csp?site=imagesonly", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "img-src http://img.example.com") || !strings.Contains(body, "connect-src encore.example.com") {
+		t.Errorf("docs lack the site's sources:\n%s", body)
+	}
+	if strings.Contains(body, "script.example.com") {
+		t.Errorf("docs include a task type the site doesn't get:\n%s", body)
+	}
+}
@@ -7,15 +7,45 @@ import (
 	"encoding/json"
 	"flag"
 	"log"
-	"net"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 
-	"github.com/abh/geoip"
+	"github.com/sburnett/encore/clientip"
+	"github.com/sburnett/encore/geolocation"
 	"github.com/sburnett/encore/store"
 )
 
-func parseQueries(queries <-chan *store.Query, geolocator *geoip.GeoIP) <-chan *store.ParsedQuery {
+// requestHeader returns the headers of a recorded request, or none if we
+// couldn't parse it.
+func requestHeader(request *http.Request) http.Header {
+	if request == nil {
+		return http.Header{}
+	}
+	return request.Header
+}
+
+// parseTiming reads a cmh-timing-<name> parameter, in milliseconds. Browsers
+// report fractions of milliseconds, which we round.
+func parseTiming(query url.Values, name string) sql.NullInt64 {
+	value := query.Get("cmh-timing-" + name)
+	if value == "" {
+		return sql.NullInt64{}
+	}
+	milliseconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || milliseconds < 0 || math.IsInf(milliseconds, 0) || math.IsNaN(milliseconds) {
+		log.Printf("invalid %s timing %q", name, value)
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{
+		Int64: int64(math.Floor(milliseconds + 0.5)),
+		Valid: true,
+	}
+}
+
+func parseQueries(queries <-chan *store.Query, geolocator geolocation.Geolocator, clientIps *clientip.Resolver) <-chan *store.ParsedQuery {
 	parsedQueries := make(chan *store.ParsedQuery)
 	go func() {
 		for query := range queries {
@@ -23,10 +53,8 @@ func parseQueries(queries <-chan *store.Query, geolocator *geoip.GeoIP) <-chan *
 			if err != nil {
 				log.Printf("error parsing result request: %v", err)
 			}
-			clientIp := request.Header.Get("X-Real-Ip")
-			if clientIp == "" {
-				clientIp = query.RemoteAddr
-			}
+			clientIp := clientIps.ClientIp(query.RemoteAddr, requestHeader(request))
+			location := geolocator.Locate(clientIp)
 
 			var parameters map[string]string
 			if err := json.Unmarshal(query.ParametersJson, &parameters); err != nil {
@@ -41,21 +69,20 @@ func parseQueries(queries <-chan *store.Query, geolocator *geoip.GeoIP) <-chan *
 				}
 			}
 
-			host, _, err := net.SplitHostPort(clientIp)
-			if err != nil {
-				host = clientIp
-			}
-
-			country, _ := geolocator.GetCountry(host)
-
 			parsedQueries <- &store.ParsedQuery{
-				Query:          query.Id,
-				MeasurementId:  parameters["measurementId"],
-				Timestamp:      query.Timestamp,
-				ClientIp:       net.ParseIP(host),
-				ClientLocation: country,
-				Substrate:      query.Substrate,
-				Parameters:     parametersNullable,
+				Query:              query.Id,
+				MeasurementId:      parameters["measurementId"],
+				Timestamp:          query.Timestamp,
+				ClientIp:           clientIp,
+				ClientLocation:     location.Country,
+				ClientAsn:          int(location.Asn),
+				ClientOrganization: location.Organization,
+				ClientCity:         location.City,
+				Substrate:          query.Substrate,
+				Parameters:         parametersNullable,
+				TemplateHash:       query.TemplateHash,
+				GitRevision:        query.GitRevision,
+				Site:               query.Site,
 			}
 		}
 		close(parsedQueries)
@@ -63,7 +90,7 @@ func parseQueries(queries <-chan *store.Query, geolocator *geoip.GeoIP) <-chan *
 	return parsedQueries
 }
 
-func parseResults(results <-chan *store.Result, geolocator *geoip.GeoIP) <-chan *store.ParsedResult {
+func parseResults(results <-chan *store.Result, geolocator geolocation.Geolocator, clientIps *clientip.Resolver) <-chan *store.ParsedResult {
 	parsedResults := make(chan *store.ParsedResult)
 	go func() {
 		for result := range results {
@@ -71,35 +98,44 @@ func parseResults(results <-chan *store.Result, geolocator *geoip.GeoIP) <-chan
 			if err != nil {
 				log.Printf("error parsing result request: %v", err)
 			}
-			measurementId := request.URL.Query().Get("cmh-id")
-			outcome := request.URL.Query().Get("cmh-result")
-			message := request.URL.Query().Get("cmh-message")
-			userAgent := request.Header.Get("User-Agent")
-			origin := request.Header.Get("Origin")
-			referer := request.Header.Get("Referer")
-			clientIp := request.Header.Get("X-Real-Ip")
-			if clientIp == "" {
-				clientIp = result.RemoteAddr
-			}
-
-			host, _, err := net.SplitHostPort(clientIp)
-			if err != nil {
-				host = clientIp
+			// Results we can't parse still get a row, with empty fields, so
+			// that we don't try them again on every run.
+			query := url.Values{}
+			if request != nil {
+				query = request.URL.Query()
 			}
-
-			country, _ := geolocator.GetCountry(host)
+			header := requestHeader(request)
+			measurementId := query.Get("cmh-id")
+			outcome := query.Get("cmh-result")
+			message := query.Get("cmh-message")
+			subTarget := query.Get("cmh-sub")
+			userAgent := header.Get("User-Agent")
+			origin := header.Get("Origin")
+			referer := header.Get("Referer")
+			clientIp := clientIps.ClientIp(result.RemoteAddr, header)
+			location := geolocator.Locate(clientIp)
 
 			parsedResults <- &store.ParsedResult{
-				Result:         result.Id,
-				Timestamp:      result.Timestamp,
-				MeasurementId:  measurementId,
-				Outcome:        outcome,
-				Message:        message,
-				Origin:         origin,
-				Referer:        referer,
-				ClientIp:       net.ParseIP(host),
-				ClientLocation: country,
-				UserAgent:      userAgent,
+				Result:             result.Id,
+				Timestamp:          result.Timestamp,
+				MeasurementId:      measurementId,
+				Outcome:            outcome,
+				Message:            message,
+				Origin:             origin,
+				Referer:            referer,
+				ClientIp:           clientIp,
+				ClientLocation:     location.Country,
+				ClientAsn:          int(location.Asn),
+				ClientOrganization: location.Organization,
+				ClientCity:         location.City,
+				UserAgent:          userAgent,
+				TimingDns:          parseTiming(query, "dns"),
+				TimingConnect:      parseTiming(query, "connect"),
+				TimingTls:          parseTiming(query, "tls"),
+				TimingRequest:      parseTiming(query, "request"),
+				TimingResponse:     parseTiming(query, "response"),
+				TimingDuration:     parseTiming(query, "duration"),
+				SubTarget:          subTarget,
 			}
 		}
 		close(parsedResults)
@@ -109,8 +145,7 @@ func parseResults(results <-chan *store.Result, geolocator *geoip.GeoIP) <-chan
 }
 
 func main() {
-	var geoipDatabase, logfile string
-	flag.StringVar(&geoipDatabase, "geoip_database", "/usr/share/GeoIP/GeoIP.dat", "Path of GeoIP database")
+	var logfile string
 	flag.StringVar(&logfile, "logfile", "", "Write logs to this file instead of stdout")
 	flag.Parse()
 
@@ -128,17 +163,16 @@ func main() {
 	s := store.Open()
 	defer s.Close()
 
-	geolocator, err := geoip.Open(geoipDatabase)
-	if err != nil {
-		panic(err)
-	}
+	clientIps := clientip.FromFlags()
+
+	geolocator := geolocation.FromFlags()
 
 	queries := s.UnparsedQueries()
-	parsedQueries := parseQueries(queries, geolocator)
+	parsedQueries := parseQueries(queries, geolocator, clientIps)
 	s.WriteParsedQueries(parsedQueries)
 
 	results := s.UnparsedResults()
-	parsedResults := parseResults(results, geolocator)
+	parsedResults := parseResults(results, geolocator, clientIps)
 	s.WriteParsedResults(parsedResults)
 
 	if err := s.ComputeResultsTables(); err != nil {
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sburnett/encore/clientip"
+	"github.com/sburnett/encore/geolocation"
+	"github.com/sburnett/encore/store"
+)
+
+func TestParseResultsKeepsUnparseableResults(t *testing.T) {
+	geolocator := geolocation.Fake{}
+	clientIps, err := clientip.NewResolver("127.0.0.1", clientip.XRealIp)
+	if err != nil {
+		t.Fatalf("error creating resolver: %v", err)
+	}
+
+	results := make(chan *store.Result, 2)
+	results <- &store.Result{
+		Id:         1,
+		Timestamp:  time.Now(),
+		RemoteAddr: "198.51.100.7:1234",
+		RawRequest: []byte("not an HTTP request"),
+	}
+	results <- &store.Result{
+		Id:         2,
+		Timestamp:  time.Now(),
+		RemoteAddr: "127.0.0.1:1234",
+		RawRequest: []byte("GET /submit?cmh-id=m1&cmh-result=init HTTP/1.1\r\nHost: example.com\r\nX-Real-Ip: 198.51.100.8\r\nReferer: http://example.com/\r\n\r\n"),
+	}
+	close(results)
+
+	var parsed []*store.ParsedResult
+	for parsedResult := range parseResults(results, geolocator, clientIps) {
+		parsed = append(parsed, parsedResult)
+	}
+	if len(parsed) != 2 {
+		t.Fatalf("got %d parsed results, want 2", len(parsed))
+	}
+
+	unparseable := parsed[0]
+	if unparseable.Result != 1 || unparseable.MeasurementId != "" || unparseable.Outcome != "" || unparseable.Referer != "" {
+		t.Errorf("unparseable result parsed as %+v, want empty fields", unparseable)
+	}
+	if !unparseable.ClientIp.Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("unparseable result client IP = %v, want the remote address", unparseable.ClientIp)
+	}
+
+	result := parsed[1]
+	if result.Result != 2 || result.MeasurementId != "m1" || result.Outcome != "init" || result.Referer != "http://example.com/" {
+		t.Errorf("result parsed as %+v", result)
+	}
+	if !result.ClientIp.Equal(net.ParseIP("198.51.100.8")) {
+		t.Errorf("result client IP = %v, want the X-Real-Ip address", result.ClientIp)
+	}
+}
+
+func TestParseEnrichesLocations(t *testing.T) {
+	geolocator := geolocation.Fake{
+		"198.51.100.0/24": {Country: "US", Asn: 64500, Organization: "Example Transit"},
+		"198.51.100.7":    {Country: "US", City: "Atlanta", Asn: 64501, Organization: "Example Access"},
+	}
+	clientIps, err := clientip.NewResolver("127.0.0.1", clientip.XRealIp)
+	if err != nil {
+		t.Fatalf("error creating resolver: %v", err)
+	}
+	request := "GET /submit?cmh-id=m1&cmh-result=init HTTP/1.1\r\nHost: example.com\r\nX-Real-Ip: %s\r\n\r\n"
+
+	queries := make(chan *store.Query, 2)
+	queries <- &store.Query{Id: 1, RemoteAddr: "127.0.0.1:1234", RawRequest: []byte(fmt.Sprintf(request, "198.51.100.7")), ParametersJson: []byte("{}")}
+	queries <- &store.Query{Id: 2, RemoteAddr: "203.0.113.1:1234", RawRequest: []byte(fmt.Sprintf(request, "198.51.100.7")), ParametersJson: []byte("{}")}
+	close(queries)
+	var queryLocations []geolocation.Location
+	for parsedQuery := range parseQueries(queries, geolocator, clientIps) {
+		queryLocations = append(queryLocations, geolocation.Location{
+			Country:      parsedQuery.ClientLocation,
+			City:         parsedQuery.ClientCity,
+			Asn:          uint(parsedQuery.ClientAsn),
+			Organization: parsedQuery.ClientOrganization,
+		})
+	}
+	// The second query didn't come through a trusted proxy, so its
+	// X-Real-Ip is ignored and its address is unknown to the geolocator.
+	wantQueries := []geolocation.Location{geolocator["198.51.100.7"], {}}
+	if !reflect.DeepEqual(queryLocations, wantQueries) {
+		t.Errorf("query locations = %+v, want %+v", queryLocations, wantQueries)
+	}
+
+	results := make(chan *store.Result, 2)
+	results <- &store.Result{Id: 1, RemoteAddr: "127.0.0.1:1234", RawRequest: []byte(fmt.Sprintf(request, "198.51.100.7"))}
+	results <- &store.Result{Id: 2, RemoteAddr: "127.0.0.1:1234", RawRequest: []byte(fmt.Sprintf(request, "198.51.100.99"))}
+	close(results)
+	var resultLocations []geolocation.Location
+	for parsedResult := range parseResults(results, geolocator, clientIps) {
+		resultLocations = append(resultLocations, geolocation.Location{
+			Country:      parsedResult.ClientLocation,
+			City:         parsedResult.ClientCity,
+			Asn:          uint(parsedResult.ClientAsn),
+			Organization: parsedResult.ClientOrganization,
+		})
+	}
+	wantResults := []geolocation.Location{geolocator["198.51.100.7"], geolocator["198.51.100.0/24"]}
+	if !reflect.DeepEqual(resultLocations, wantResults) {
+		t.Errorf("result locations = %+v, want %+v", resultLocations, wantResults)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sburnett/encore/store"
+)
+
+// taskTypeParameters describes the parameters that the template of a task
+// type uses. The target of a row becomes the Target parameter.
+type taskTypeParameters struct {
+	Target   string
+	Required []string
+	Optional []string
+}
+
+var taskTypes = map[string]taskTypeParameters{
+	"img": {
+		Target: "imageUrl",
+	},
+	"script": {
+		Target: "scriptUrl",
+	},
+	"css": {
+		Target:   "cssUrl",
+		Required: []string{"cssId", "cssAttribute", "cssDesiredValue"},
+		Optional: []string{"controlCssId"},
+	},
+	"iframe-load": {
+		Target: "iframeUrl",
+	},
+	"iframe-cache": {
+		Target:   "iframeUrl",
+		Required: []string{"imageUrl"},
+		Optional: []string{"controlImageUrl"},
+	},
+	"fetch": {
+		Target: "fetchUrl",
+	},
+	"img-multi": {
+		Target:   "imageUrls",
+		Optional: []string{"controlImageUrl"},
+	},
+}
+
+// Imported tasks are tagged with these parameters. They don't count when
+// deciding whether two tasks are the same.
+const (
+	listNameParameter = "listName"
+	categoryParameter = "category"
+)
+
+// parameterList is a repeatable key=value flag.
+type parameterList map[string]string
+
+func (parameters parameterList) String() string {
+	var pairs []string
+	for k, v := range parameters {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (parameters parameterList) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	parameters[fields[0]] = fields[1]
+	return nil
+}
+
+type importOptions struct {
+	ListName   string
+	Category   string
+	TaskType   string
+	Format     string
+	Parameters parameterList
+	DryRun     bool
+}
+
+// targetRow is one line of a target list. Line is for error messages.
+type targetRow struct {
+	Line   int
+	Fields map[string]string
+}
+
+// readCsv reads a CSV file with a header row.
+func readCsv(r io.Reader) ([]targetRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var rows []targetRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]string)
+		for i, value := range record {
+			if i < len(header) {
+				fields[header[i]] = strings.TrimSpace(value)
+			}
+		}
+		rows = append(rows, targetRow{
+			Line:   line,
+			Fields: fields,
+		})
+	}
+	return rows, nil
+}
+
+// readJsonl reads one JSON object of strings per line.
+func readJsonl(r io.Reader) ([]targetRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var rows []targetRow
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		fields := make(map[string]string)
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		for k, v := range fields {
+			fields[k] = strings.TrimSpace(v)
+		}
+		rows = append(rows, targetRow{
+			Line:   line,
+			Fields: fields,
+		})
+	}
+	return rows, scanner.Err()
+}
+
+func readTargetList(path, format string) ([]targetRow, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			format = "csv"
+		case ".jsonl", ".json":
+			format = "jsonl"
+		default:
+			return nil, fmt.Errorf("cannot infer format of %s; use -format", path)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch format {
+	case "csv":
+		return readCsv(f)
+	case "jsonl":
+		return readJsonl(f)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// buildTask turns a row into task parameters. Rows name their target in a
+// "url" column or in the target parameter of the task type, and may override
+// the task type and category. Columns that the task type doesn't use are
+// ignored.
+func buildTask(row targetRow, options importOptions) (*store.Task, error) {
+	lookup := func(key string) string {
+		if value := row.Fields[key]; value != "" {
+			return value
+		}
+		return options.Parameters[key]
+	}
+
+	taskType := lookup("taskType")
+	if taskType == "" {
+		taskType = options.TaskType
+	}
+	parameters, ok := taskTypes[taskType]
+	if !ok {
+		return nil, fmt.Errorf("unknown task type %q", taskType)
+	}
+
+	target := lookup("url")
+	if target == "" {
+		target = lookup(parameters.Target)
+	}
+	if target == "" {
+		return nil, fmt.Errorf("missing url")
+	}
+
+	category := lookup("category")
+	if category == "" {
+		category = lookup("category_code")
+	}
+	if category == "" {
+		category = options.Category
+	}
+
+	task := store.Task{
+		Parameters: make(map[string]sql.NullString),
+	}
+	set := func(key, value string) {
+		task.Parameters[key] = sql.NullString{
+			String: value,
+			Valid:  true,
+		}
+	}
+	set("taskType", taskType)
+	set(parameters.Target, target)
+	for _, key := range parameters.Required {
+		value := lookup(key)
+		if value == "" {
+			return nil, fmt.Errorf("task type %s needs %s", taskType, key)
+		}
+		set(key, value)
+	}
+	for _, key := range parameters.Optional {
+		if value := lookup(key); value != "" {
+			set(key, value)
+		}
+	}
+	set(listNameParameter, options.ListName)
+	if category != "" {
+		set(categoryParameter, category)
+	}
+	return &task, nil
+}
+
+// taskKey identifies what a task measures, so that the same measurement isn't
+// imported twice from different lists.
+func taskKey(task *store.Task) string {
+	var pairs []string
+	for k, v := range task.Parameters {
+		if k == listNameParameter || k == categoryParameter || !v.Valid {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%q=%q", k, v.String))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func importTargetLists(s store.Store, paths []string, options importOptions) error {
+	if options.ListName == "" {
+		return fmt.Errorf("-list is required")
+	}
+
+	existing := make(map[string]int)
+	for task := range s.AllTasks() {
+		existing[taskKey(task)] = task.Id
+	}
+
+	var tasks []*store.Task
+	duplicates, invalid := 0, 0
+	for _, path := range paths {
+		rows, err := readTargetList(path, options.Format)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", path, err)
+		}
+		for _, row := range rows {
+			task, err := buildTask(row, options)
+			if err != nil {
+				log.Printf("skipping %s:%d: %v", path, row.Line, err)
+				invalid++
+				continue
+			}
+			key := taskKey(task)
+			if id, ok := existing[key]; ok {
+				if id != 0 {
+					log.Printf("skipping %s:%d: same as task %d", path, row.Line, id)
+				} else {
+					log.Printf("skipping %s:%d: duplicate in input", path, row.Line)
+				}
+				duplicates++
+				continue
+			}
+			existing[key] = 0
+			tasks = append(tasks, task)
+		}
+	}
+
+	if options.DryRun {
+		for _, task := range tasks {
+			fmt.Printf("would insert\t%s\n", describeTask(task))
+		}
+		fmt.Printf("would insert %d tasks; skipped %d duplicates and %d invalid rows\n", len(tasks), duplicates, invalid)
+		return nil
+	}
+
+	ids, err := s.InsertTasks(tasks)
+	if err != nil {
+		return fmt.Errorf("error inserting tasks: %v", err)
+	}
+	for i, id := range ids {
+		fmt.Printf("inserted %d\t%s\n", id, describeTask(tasks[i]))
+	}
+	fmt.Printf("inserted %d tasks; skipped %d duplicates and %d invalid rows\n", len(ids), duplicates, invalid)
+	return nil
+}
+
+func describeTask(task *store.Task) string {
+	taskType := task.Parameters["taskType"].String
+	return fmt.Sprintf("%s\t%s\t%s", taskType, task.Parameters[taskTypes[taskType].Target].String, task.Parameters[categoryParameter].String)
+}
+
+func runImport(args []string) {
+	options := importOptions{
+		Parameters: make(parameterList),
+	}
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&options.ListName, "list", "", "Name of the target list, recorded in the listName parameter of each task")
+	flags.StringVar(&options.Category, "category", "", "Category of rows that don't have a category or category_code column")
+	flags.StringVar(&options.TaskType, "task_type", "img", "Task type of rows that don't have a taskType column")
+	flags.StringVar(&options.Format, "format", "", "csv or jsonl. Inferred from the file extension if empty")
+	flags.Var(options.Parameters, "set", "key=value parameter for rows that don't have that column. Repeatable")
+	flags.BoolVar(&options.DryRun, "dry_run", false, "Report what would be inserted without inserting anything")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: encore-tasks [store flags] import [flags] <target list>...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	s := store.Open()
+	defer s.Close()
+
+	if err := importTargetLists(s, flags.Args(), options); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,54 @@
+// encore-tasks manages the tasks table.
+//
+//     encore-tasks [store flags] import [flags] <target list>...
+//
+// imports target lists in CSV or JSONL format.
+//
+//     encore-tasks [store flags] validate [flags]
+//
+// checks that every task has templates and the parameters they use.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: encore-tasks [store flags] <command> [flags] [args]\n\ncommands:\n  import    import target lists into tasks\n  validate  check tasks against task templates\n\nstore flags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var logfile string
+	flag.StringVar(&logfile, "logfile", "", "Write logs to this file instead of stderr")
+	flag.Usage = usage
+	flag.Parse()
+
+	if logfile != "" {
+		f, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("error opening logfile: %v", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "import":
+		runImport(flag.Args()[1:])
+	case "validate":
+		runValidate(flag.Args()[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+}
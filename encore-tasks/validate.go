@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/sburnett/encore/store"
+	"github.com/sburnett/encore/tasktemplate"
+)
+
+// runValidate checks tasks against the task templates, exiting with status 1
+// if any task would fail to render.
+func runValidate(args []string) {
+	var taskTemplatesPath string
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.StringVar(&taskTemplatesPath, "task_templates_path", "task-templates", "Path to task templates")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: encore-tasks [store flags] validate [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	templates, err := tasktemplate.Parse(taskTemplatesPath)
+	if err != nil {
+		log.Fatalf("error parsing task templates: %v", err)
+	}
+
+	s := store.Open()
+	defer s.Close()
+
+	problems := tasktemplate.Validate(templates, s.AllTasks())
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		s.Close()
+		os.Exit(1)
+	}
+	fmt.Println("all tasks are valid")
+}
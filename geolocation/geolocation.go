@@ -0,0 +1,148 @@
+// Package geolocation maps client addresses to where they are on the map and
+// on the network.
+package geolocation
+
+import (
+	"flag"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/abh/geoip"
+	"github.com/oschwald/geoip2-golang"
+)
+
+var geoipDatabase = flag.String("geoip_database", "/usr/share/GeoIP/GeoIP.dat", "Path of GeoIP country database, either a legacy GeoIP.dat or a GeoIP2 .mmdb file such as GeoLite2-Country.mmdb. Empty disables country lookups.")
+var geoipAsnDatabase = flag.String("geoip_asn_database", "", "Path of GeoLite2 ASN .mmdb database. Optional.")
+var geoipCityDatabase = flag.String("geoip_city_database", "", "Path of GeoLite2 City .mmdb database. Optional.")
+
+// Location is what we know about an address. Fields are empty or zero when
+// we don't know them.
+type Location struct {
+	Country      string
+	City         string
+	Asn          uint
+	Organization string
+}
+
+type Geolocator interface {
+	Locate(ip net.IP) Location
+}
+
+// FromFlags opens the databases named by -geoip_database,
+// -geoip_asn_database and -geoip_city_database.
+func FromFlags() Geolocator {
+	geolocator, err := Open(*geoipDatabase, *geoipAsnDatabase, *geoipCityDatabase)
+	if err != nil {
+		log.Fatalf("error opening geoip database: %v", err)
+	}
+	return geolocator
+}
+
+// Open opens optional country, ASN and city databases. The country database
+// may be a legacy GeoIP.dat file.
+func Open(countryPath, asnPath, cityPath string) (Geolocator, error) {
+	geolocator := &mmdbGeolocator{}
+	if countryPath == "" {
+		log.Printf("not looking up countries")
+	} else if strings.ToLower(filepath.Ext(countryPath)) == ".dat" {
+		legacy, err := geoip.Open(countryPath)
+		if err != nil {
+			return nil, err
+		}
+		geolocator.legacy = legacy
+	} else {
+		country, err := geoip2.Open(countryPath)
+		if err != nil {
+			return nil, err
+		}
+		geolocator.country = country
+	}
+	if asnPath != "" {
+		asn, err := geoip2.Open(asnPath)
+		if err != nil {
+			return nil, err
+		}
+		geolocator.asn = asn
+	}
+	if cityPath != "" {
+		city, err := geoip2.Open(cityPath)
+		if err != nil {
+			return nil, err
+		}
+		geolocator.city = city
+	}
+	return geolocator, nil
+}
+
+// mmdbGeolocator reads MaxMind databases. Any of them may be nil.
+type mmdbGeolocator struct {
+	country *geoip2.Reader
+	legacy  *geoip.GeoIP
+	asn     *geoip2.Reader
+	city    *geoip2.Reader
+}
+
+func (geolocator *mmdbGeolocator) Locate(ip net.IP) Location {
+	var location Location
+	if ip == nil {
+		return location
+	}
+
+	if geolocator.legacy != nil {
+		location.Country, _ = geolocator.legacy.GetCountry(ip.String())
+	} else if geolocator.country != nil {
+		if record, err := geolocator.country.Country(ip); err != nil {
+			log.Printf("error looking up country of %s: %v", ip, err)
+		} else {
+			location.Country = record.Country.IsoCode
+		}
+	}
+
+	if geolocator.asn != nil {
+		if record, err := geolocator.asn.ASN(ip); err != nil {
+			log.Printf("error looking up ASN of %s: %v", ip, err)
+		} else {
+			location.Asn = record.AutonomousSystemNumber
+			location.Organization = record.AutonomousSystemOrganization
+		}
+	}
+
+	if geolocator.city != nil {
+		if record, err := geolocator.city.City(ip); err != nil {
+			log.Printf("error looking up city of %s: %v", ip, err)
+		} else {
+			location.City = record.City.Names["en"]
+			if location.Country == "" {
+				location.Country = record.Country.IsoCode
+			}
+		}
+	}
+	return location
+}
+
+// Fake locates addresses from a map, for tests. Keys are addresses or CIDRs;
+// the most specific match wins.
+type Fake map[string]Location
+
+func (fake Fake) Locate(ip net.IP) Location {
+	if ip == nil {
+		return Location{}
+	}
+	if location, ok := fake[ip.String()]; ok {
+		return location
+	}
+	var best Location
+	bestBits := -1
+	for key, location := range fake {
+		_, network, err := net.ParseCIDR(key)
+		if err != nil || !network.Contains(ip) {
+			continue
+		}
+		if bits, _ := network.Mask.Size(); bits > bestBits {
+			best, bestBits = location, bits
+		}
+	}
+	return best
+}
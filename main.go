@@ -5,16 +5,20 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/ParsePlatform/go.grace/gracehttp"
 	"github.com/sburnett/cube"
+	"github.com/sburnett/encore/clientip"
+	"github.com/sburnett/encore/geolocation"
 	"github.com/sburnett/encore/store"
 )
 
 var debugMode bool
 
 func main() {
-	var listenAddress, serverUrl, taskTemplatesPath, statsTemplatesPath, staticPath, cubeCollectionType, logfile, geoipDatabase string
+	var listenAddress, serverUrl, taskTemplatesPath, statsTemplatesPath, staticPath, cubeCollectionType, logfile, adminToken, measurementIdKeyFile string
 	flag.BoolVar(&debugMode, "debug", false, "Enable parsing of cmh- debug parameters in requests")
 	flag.StringVar(&listenAddress, "listen_address", "127.0.0.1:8080", "")
 	flag.StringVar(&serverUrl, "server_url", "http://localhost:8080", "URL that clients should use to contact this server.")
@@ -23,7 +27,8 @@ func main() {
 	flag.StringVar(&staticPath, "static_path", "static", "Path to static content to serve")
 	flag.StringVar(&cubeCollectionType, "cube_collection_type", "encore", "Use this label for statistics we send to Cube")
 	flag.StringVar(&logfile, "logfile", "", "Write logs to this file instead of stdout")
-	flag.StringVar(&geoipDatabase, "geoip_database", "/usr/share/GeoIP/GeoIP.dat", "Path of GeoIP database")
+	flag.StringVar(&measurementIdKeyFile, "measurement_id_key_file", "", "File containing the key that signs measurement ids, e.g. made with head -c 32 /dev/urandom | base64. Instances sharing a database need the same key.")
+	flag.StringVar(&adminToken, "admin_token", "", "Bearer token for the admin API under /admin/. The admin API is disabled if empty.")
 	flag.Parse()
 
 	printVersionIfAsked()
@@ -46,18 +51,37 @@ func main() {
 	s := store.Open()
 	defer s.Close()
 
-	tasksServer := NewTaskServer(s, serverUrl, taskTemplatesPath, geoipDatabase)
-	submissionServer := NewSubmissionServer(s)
-	statsServer := NewStatsServer(s, statsTemplatesPath)
+	signer := newMeasurementIdSigner(measurementIdKeyFile)
+	clientIps := clientip.FromFlags()
+	sites := newSiteRegistry(s)
+	tasksServer := NewTaskServer(s, serverUrl, taskTemplatesPath, geolocation.FromFlags(), signer, clientIps, sites)
+	submissionServer := NewSubmissionServer(s, signer, clientIps)
+	statsServer := NewStatsServer(s, statsTemplatesPath, sites)
+
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for _ = range reloadSignals {
+			log.Printf("reloading task templates on SIGHUP")
+			tasksServer.ReloadTemplates()
+		}
+	}()
 
 	mux := http.NewServeMux()
 	mux.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(staticPath))))
-	mux.Handle("/task.js", tasksServer)
-	mux.Handle("/task.html", tasksServer)
-	mux.Handle("/submit", submissionServer)
+	rateLimitedTasksServer := rateLimitTasks(tasksServer, clientIps)
+	mux.Handle("/task.js", rateLimitedTasksServer)
+	mux.Handle("/task.html", rateLimitedTasksServer)
+	mux.Handle("/task.json", rateLimitedTasksServer)
+	mux.Handle("/submit", rateLimitSubmissions(submissionServer, clientIps))
+	mux.Handle("/optout", NewOptOutServer(serverUrl))
+	mux.Handle("/csp", NewCspDocsServer(s, serverUrl, sites))
 	mux.HandleFunc("/version", versionServer)
 	mux.Handle("/stats/", statsServer)
 	mux.HandleFunc("/stats/refer", refererRedirect)
+	if adminToken != "" {
+		mux.Handle("/admin/", NewAdminServer(s, adminToken, tasksServer, sites))
+	}
 	server := http.Server{
 		Addr:    listenAddress,
 		Handler: mux,
@@ -1,20 +1,91 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"math/rand"
-	"time"
+	"io/ioutil"
+	"log"
+	"strings"
 
 	"github.com/rcrowley/go-metrics"
 )
 
-func generateMeasurementIds() <-chan string {
+// Measurement ids are a random nonce and an HMAC of the nonce under a server
+// key, both hex encoded and separated by a dot. Only servers with the key can
+// make ids that verify, so results with made up ids can be told apart. They
+// are stored but never parsed or counted.
+const (
+	measurementIdNonceBytes     = 12
+	measurementIdSignatureBytes = 16
+	minMeasurementIdKeyBytes    = 16
+)
+
+type measurementIdSigner struct {
+	key []byte
+}
+
+// newMeasurementIdSigner reads the key from keyFile. Every instance that
+// serves tasks or accepts results for the same database needs the same key.
+// Without a key file we make a key that lasts until the server exits, which
+// is only good for running a single instance.
+func newMeasurementIdSigner(keyFile string) *measurementIdSigner {
+	if keyFile == "" {
+		log.Printf("no -measurement_id_key_file; generating a key that won't survive a restart")
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("error generating measurement id key: %v", err)
+		}
+		return &measurementIdSigner{key}
+	}
+
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		log.Fatalf("error reading measurement id key: %v", err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < minMeasurementIdKeyBytes {
+		log.Fatalf("measurement id key in %s is too short; use at least %d bytes", keyFile, minMeasurementIdKeyBytes)
+	}
+	return &measurementIdSigner{key}
+}
+
+func (signer *measurementIdSigner) sign(nonce string) string {
+	mac := hmac.New(sha256.New, signer.key)
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil)[:measurementIdSignatureBytes])
+}
+
+func (signer *measurementIdSigner) generate() (string, error) {
+	nonce := make([]byte, measurementIdNonceBytes)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	encoded := hex.EncodeToString(nonce)
+	return fmt.Sprintf("%s.%s", encoded, signer.sign(encoded)), nil
+}
+
+// verify reports whether we signed measurementId.
+func (signer *measurementIdSigner) verify(measurementId string) bool {
+	fields := strings.Split(measurementId, ".")
+	if len(fields) != 2 {
+		return false
+	}
+	return hmac.Equal([]byte(fields[1]), []byte(signer.sign(fields[0])))
+}
+
+func generateMeasurementIds(signer *measurementIdSigner) <-chan string {
 	measurementIds := make(chan string)
 	measurementIdCounter := metrics.GetOrRegisterCounter("MeasurementIdsGenerated", nil)
 	go func() {
-		r := rand.NewSource(time.Now().UnixNano())
 		for {
-			id := fmt.Sprintf("%016x", r.Int63())
+			id, err := signer.generate()
+			if err != nil {
+				log.Fatalf("error generating measurement id: %v", err)
+			}
 			measurementIds <- id
 			measurementIdCounter.Inc(1)
 		}
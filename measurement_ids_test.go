@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testSigner() *measurementIdSigner {
+	return &measurementIdSigner{key: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func TestMeasurementIdRoundTrip(t *testing.T) {
+	signer := testSigner()
+	for i := 0; i < 10; i++ {
+		id, err := signer.generate()
+		if err != nil {
+			t.Fatalf("error generating measurement id: %v", err)
+		}
+		if !signer.verify(id) {
+			t.Errorf("verify(%q) = false, want true", id)
+		}
+	}
+}
+
+func TestMeasurementIdsAreUnique(t *testing.T) {
+	signer := testSigner()
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := signer.generate()
+		if err != nil {
+			t.Fatalf("error generating measurement id: %v", err)
+		}
+		if seen[id] {
+			t.Fatalf("generated %q twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestMeasurementIdRejected(t *testing.T) {
+	signer := testSigner()
+	id, err := signer.generate()
+	if err != nil {
+		t.Fatalf("error generating measurement id: %v", err)
+	}
+	fields := strings.Split(id, ".")
+	nonce, signature := fields[0], fields[1]
+
+	// Flip the last hex digit of the nonce.
+	last := nonce[len(nonce)-1]
+	flipped := byte('0')
+	if last == '0' {
+		flipped = '1'
+	}
+	tamperedNonce := nonce[:len(nonce)-1] + string(flipped)
+
+	otherSigner := &measurementIdSigner{key: []byte("fedcba9876543210fedcba9876543210")}
+	otherId, err := otherSigner.generate()
+	if err != nil {
+		t.Fatalf("error generating measurement id: %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		id   string
+	}{
+		{"empty", ""},
+		{"tampered nonce", tamperedNonce + "." + signature},
+		{"truncated signature", nonce + "." + signature[:len(signature)-2]},
+		{"empty signature", nonce + "."},
+		{"missing separator", nonce + signature},
+		{"nonce only", nonce},
+		{"extra field", id + "." + signature},
+		{"other key", otherId},
+		{"uppercase signature", nonce + "." + strings.ToUpper(signature)},
+	} {
+		if test.id == id {
+			continue
+		}
+		if signer.verify(test.id) {
+			t.Errorf("%s: verify(%q) = true, want false", test.name, test.id)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Visitors opt out of Encore on /optout, which sets a cookie on our origin
+// that the task server reads as the "disable" hint:
+//
+//     GET    /optout   show whether this browser has opted out
+//     POST   /optout   opt out, or opt back in with optout=false
+//     DELETE /optout   opt back in
+//
+// Requests that accept application/json get {"OptedOut": ...} back; browsers
+// submitting the form are redirected back to the page.
+
+const optOutCookieName = hintPrefix + "disable"
+
+// Long enough that visitors don't have to opt out again, which browsers may
+// shorten anyway.
+const optOutCookieMaxAge = 5 * 365 * 24 * time.Hour
+
+var optOutRequests = metrics.GetOrRegisterCounter("OptOutRequests", nil)
+var optInRequests = metrics.GetOrRegisterCounter("OptInRequests", nil)
+var optOutPageErrorCount = metrics.GetOrRegisterCounter("OptOutPageError", nil)
+
+var optOutPage = template.Must(template.New("optout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Encore opt-out</title>
+</head>
+<body>
+<h1>Encore opt-out</h1>
+<p>Encore measures Web filtering by asking visitors' browsers to load
+resources from other sites.</p>
+{{if .OptedOut}}
+<p>This browser has opted out. Encore won't measure it on any site.</p>
+<form method="post" action="/optout">
+<input type="hidden" name="optout" value="false">
+<input type="submit" value="Opt back in">
+</form>
+{{else}}
+{{if .Gpc}}<p>This browser sends Global Privacy Control, so Encore won't measure it.</p>{{end}}
+{{if .Dnt}}<p>This browser sends Do Not Track, so Encore won't measure it.</p>{{end}}
+<p>Opting out stores a cookie in this browser. Clearing your cookies opts you
+back in.</p>
+<form method="post" action="/optout">
+<input type="hidden" name="optout" value="true">
+<input type="submit" value="Opt out">
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type optOutState struct {
+	Secure bool
+}
+
+// NewOptOutServer marks the cookie Secure when clients reach us over HTTPS.
+// Browsers only send it with task requests from other sites if it is.
+func NewOptOutServer(serverUrl string) http.Handler {
+	return &optOutState{
+		Secure: strings.HasPrefix(serverUrl, "https:"),
+	}
+}
+
+func optedOut(r *http.Request) bool {
+	cookie, err := r.Cookie(optOutCookieName)
+	return err == nil && cookie.Value == "true"
+}
+
+func (state *optOutState) setCookie(w http.ResponseWriter, optOut bool) {
+	cookie := &http.Cookie{
+		Name:     optOutCookieName,
+		Value:    "true",
+		Path:     "/",
+		MaxAge:   int(optOutCookieMaxAge / time.Second),
+		Expires:  time.Now().Add(optOutCookieMaxAge),
+		HttpOnly: true,
+		Secure:   state.Secure,
+	}
+	if state.Secure {
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	if !optOut {
+		cookie.Value = ""
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(0, 0)
+	}
+	http.SetCookie(w, cookie)
+}
+
+func wantsJson(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (state *optOutState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	var optOut bool
+	switch r.Method {
+	case "GET", "HEAD":
+		state.showStatus(w, r, optedOut(r))
+		return
+	case "POST":
+		optOut = r.FormValue("optout") != "false"
+	case "DELETE":
+		optOut = false
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state.setCookie(w, optOut)
+	if optOut {
+		log.Printf("user opted out of Encore on /optout")
+		optOutRequests.Inc(1)
+	} else {
+		log.Printf("user opted back in to Encore on /optout")
+		optInRequests.Inc(1)
+	}
+
+	if wantsJson(r) {
+		state.showStatus(w, r, optOut)
+		return
+	}
+	http.Redirect(w, r, "/optout", http.StatusSeeOther)
+}
+
+func (state *optOutState) showStatus(w http.ResponseWriter, r *http.Request, optOut bool) {
+	if wantsJson(r) {
+		writeJson(w, http.StatusOK, struct {
+			OptedOut bool
+		}{
+			OptedOut: optOut,
+		})
+		return
+	}
+
+	page := bytes.Buffer{}
+	if err := optOutPage.Execute(&page, struct {
+		OptedOut bool
+		Gpc      bool
+		Dnt      bool
+	}{
+		OptedOut: optOut,
+		Gpc:      *honorGpc && r.Header.Get("Sec-GPC") == "1",
+		Dnt:      *honorDnt && r.Header.Get("DNT") == "1",
+	}); err != nil {
+		log.Printf("error executing opt-out page: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		optOutPageErrorCount.Inc(1)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page.WriteTo(w)
+}
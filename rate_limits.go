@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sburnett/encore/clientip"
+	"github.com/sburnett/encore/ratelimit"
+)
+
+// Rates are requests per second and bursts are how many requests may arrive
+// at once. A rate of 0 disables that limit. Clients are identified by their
+// resolved address and referers as we count results under them.
+var taskClientRate = flag.Float64("task_client_rate", 0, "Requests per second each client address may make for tasks. 0 disables the limit.")
+var taskClientBurst = flag.Int("task_client_burst", 10, "Task requests a client address may make at once.")
+var taskRefererRate = flag.Float64("task_referer_rate", 0, "Requests per second for tasks from pages of each referer. 0 disables the limit.")
+var taskRefererBurst = flag.Int("task_referer_burst", 100, "Task requests from pages of a referer at once.")
+var submitClientRate = flag.Float64("submit_client_rate", 0, "Results per second each client address may submit. 0 disables the limit.")
+var submitClientBurst = flag.Int("submit_client_burst", 30, "Results a client address may submit at once.")
+var submitRefererRate = flag.Float64("submit_referer_rate", 0, "Results per second submitted from pages of each referer. 0 disables the limit.")
+var submitRefererBurst = flag.Int("submit_referer_burst", 300, "Results submitted from pages of a referer at once.")
+
+// rateLimitedHandler answers 429 to requests over either limit before they
+// reach Handler, so they never touch the store.
+type rateLimitedHandler struct {
+	Handler        http.Handler
+	ClientIps      *clientip.Resolver
+	Clients        *ratelimit.Limiter
+	Referers       *ratelimit.Limiter
+	ClientLimited  metrics.Counter
+	RefererLimited metrics.Counter
+}
+
+func newRateLimitedHandler(name string, handler http.Handler, clientIps *clientip.Resolver, clients, referers *ratelimit.Limiter) http.Handler {
+	if clients == nil && referers == nil {
+		return handler
+	}
+	return &rateLimitedHandler{
+		Handler:        handler,
+		ClientIps:      clientIps,
+		Clients:        clients,
+		Referers:       referers,
+		ClientLimited:  metrics.GetOrRegisterCounter(name+"ClientRateLimited", nil),
+		RefererLimited: metrics.GetOrRegisterCounter(name+"RefererRateLimited", nil),
+	}
+}
+
+func rateLimitTasks(handler http.Handler, clientIps *clientip.Resolver) http.Handler {
+	return newRateLimitedHandler("Tasks", handler, clientIps, ratelimit.New(*taskClientRate, *taskClientBurst), ratelimit.New(*taskRefererRate, *taskRefererBurst))
+}
+
+func rateLimitSubmissions(handler http.Handler, clientIps *clientip.Resolver) http.Handler {
+	return newRateLimitedHandler("Submissions", handler, clientIps, ratelimit.New(*submitClientRate, *submitClientBurst), ratelimit.New(*submitRefererRate, *submitRefererBurst))
+}
+
+func tooManyRequests(w http.ResponseWriter, limiter *ratelimit.Limiter) {
+	// Results come from other sites, which need this to see the response.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(limiter.RetryAfter().Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+func (handler *rateLimitedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler.Clients != nil {
+		client := handler.ClientIps.RequestClientIp(r)
+		if client != nil && !handler.Clients.Allow(client.String()) {
+			log.Printf("rate limiting client %v", client)
+			handler.ClientLimited.Inc(1)
+			tooManyRequests(w, handler.Clients)
+			return
+		}
+	}
+	if handler.Referers != nil && r.Referer() != "" {
+		referer, err := formatReferer(r.Referer())
+		if err == nil && !handler.Referers.Allow(referer) {
+			log.Printf("rate limiting referer %s", referer)
+			handler.RefererLimited.Inc(1)
+			tooManyRequests(w, handler.Referers)
+			return
+		}
+	}
+	handler.Handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,97 @@
+// Package ratelimit keeps a token bucket per key, such as a client address or
+// a referer.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// How often Allow forgets keys whose buckets have refilled. A full bucket
+// behaves the same as no bucket, so this only bounds memory.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter lets each key make Burst requests at once and Rate requests per
+// second after that. It is safe for concurrent use.
+type Limiter struct {
+	Rate  float64
+	Burst int
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New returns a Limiter, or nil if rate isn't positive. A nil Limiter allows
+// everything.
+func New(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (limiter *Limiter) refill(b *bucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * limiter.Rate
+	if b.tokens > float64(limiter.Burst) {
+		b.tokens = float64(limiter.Burst)
+	}
+	b.last = now
+}
+
+func (limiter *Limiter) sweep(now time.Time) {
+	for key, b := range limiter.buckets {
+		limiter.refill(b, now)
+		if b.tokens >= float64(limiter.Burst) {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.lastSweep = now
+}
+
+// Allow takes a token from key's bucket and reports whether there was one.
+func (limiter *Limiter) Allow(key string) bool {
+	if limiter == nil {
+		return true
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(limiter.lastSweep) > sweepInterval {
+		limiter.sweep(now)
+	}
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{
+			tokens: float64(limiter.Burst),
+			last:   now,
+		}
+		limiter.buckets[key] = b
+	}
+	limiter.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RetryAfter is how long a rejected client should wait for a token.
+func (limiter *Limiter) RetryAfter() time.Duration {
+	return time.Duration(float64(time.Second) / limiter.Rate)
+}
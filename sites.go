@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sburnett/encore/store"
+)
+
+// Webmasters register their sites in the sites table, usually through the
+// admin API, and embed /task.js?site=<key>. Queries from registered sites are
+// attributed to the site instead of the Referer, and the site's settings
+// decide which task types its visitors get and whether its pages show
+// statistics.
+
+var requireSiteKey = flag.Bool("require_site_key", false, "Only serve tasks to pages that pass the key of an enabled registered site.")
+var sitesRefreshInterval = flag.Duration("sites_refresh_interval", time.Minute, "Reread registered sites from the database this often.")
+
+var siteRefreshErrorCount = metrics.GetOrRegisterCounter("SiteRefreshError", nil)
+
+const siteKeyBytes = 16
+
+// siteRegistry caches the enabled sites, so that serving a task doesn't need
+// a database round trip.
+type siteRegistry struct {
+	store store.Store
+	mutex sync.RWMutex
+	byKey map[string]store.Site
+}
+
+func newSiteRegistry(s store.Store) *siteRegistry {
+	registry := &siteRegistry{
+		store: s,
+	}
+	if err := registry.Refresh(); err != nil {
+		log.Fatalf("error reading sites: %v", err)
+	}
+	if *sitesRefreshInterval > 0 {
+		go func() {
+			for _ = range time.Tick(*sitesRefreshInterval) {
+				if err := registry.Refresh(); err != nil {
+					log.Printf("error refreshing sites, keeping the previous ones: %v", err)
+					siteRefreshErrorCount.Inc(1)
+				}
+			}
+		}()
+	}
+	return registry
+}
+
+// Refresh rereads sites from the store.
+func (registry *siteRegistry) Refresh() error {
+	sites, err := registry.store.Sites()
+	if err != nil {
+		return err
+	}
+	byKey := make(map[string]store.Site)
+	for _, site := range sites {
+		if site.Enabled {
+			byKey[site.Key] = site
+		}
+	}
+	registry.mutex.Lock()
+	registry.byKey = byKey
+	registry.mutex.Unlock()
+	return nil
+}
+
+// Lookup returns the enabled site with key.
+func (registry *siteRegistry) Lookup(key string) (store.Site, bool) {
+	if key == "" {
+		return store.Site{}, false
+	}
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	site, ok := registry.byKey[key]
+	return site, ok
+}
+
+func newSiteKey() (string, error) {
+	key := make([]byte, siteKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
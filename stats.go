@@ -13,18 +13,24 @@ import (
 
 type statsState struct {
 	CountResultsRequests      chan store.CountResultsRequest
+	CountOptOutsRequests      chan store.CountResultsRequest
 	ResultsPerDayRequests     chan store.ResultsPerDayRequest
 	ResultsPerCountryRequests chan store.ResultsPerCountryRequest
+	Sites                     *siteRegistry
 }
 
 var refererRedirects = metrics.GetOrRegisterCounter("StatsRefererRedirects", nil)
 var statsHits = metrics.GetOrRegisterCounter("StatsHits", nil)
+var statsNotSharedCount = metrics.GetOrRegisterCounter("StatsNotShared", nil)
 var statsTemplateExecutionErrorCount = metrics.GetOrRegisterCounter("StatsTemplateExecutionError", nil)
 
-func NewStatsServer(s store.Store, templatesPath string) http.Handler {
+func NewStatsServer(s store.Store, templatesPath string, sites *siteRegistry) http.Handler {
 	countResultsRequests := make(chan store.CountResultsRequest)
 	go s.CountResultsForReferrer(countResultsRequests)
 
+	countOptOutsRequests := make(chan store.CountResultsRequest)
+	go s.CountOptOutsForReferrer(countOptOutsRequests)
+
 	resultsPerDayRequests := make(chan store.ResultsPerDayRequest)
 	go s.ResultsPerDayForReferrer(resultsPerDayRequests)
 
@@ -33,8 +39,10 @@ func NewStatsServer(s store.Store, templatesPath string) http.Handler {
 
 	return &statsState{
 		CountResultsRequests:      countResultsRequests,
+		CountOptOutsRequests:      countOptOutsRequests,
 		ResultsPerDayRequests:     resultsPerDayRequests,
 		ResultsPerCountryRequests: resultsPerCountryRequests,
+		Sites:                     sites,
 	}
 }
 
@@ -50,8 +58,11 @@ func refererRedirect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	parameters := url.Values{}
-	parameters.Set("referer", referer)
-	parameters.Encode()
+	if site := r.URL.Query().Get("site"); site != "" {
+		parameters.Set("site", site)
+	} else {
+		parameters.Set("referer", referer)
+	}
 
 	redirectUrl := url.URL{
 		Path:     "/stats.html",
@@ -72,9 +83,12 @@ func formatReferer(refererString string) (string, error) {
 	return referer.String(), nil
 }
 
-func countResults(requests chan store.CountResultsRequest, referer string) (int, error) {
+// These count for site if it isn't 0, and for referer otherwise.
+
+func countResults(requests chan store.CountResultsRequest, referer string, site int) (int, error) {
 	request := store.CountResultsRequest{
 		Referer:  referer,
+		Site:     site,
 		Response: make(chan store.CountResultsResponse),
 	}
 	requests <- request
@@ -82,9 +96,10 @@ func countResults(requests chan store.CountResultsRequest, referer string) (int,
 	return response.Count, response.Err
 }
 
-func resultsPerDay(requests chan store.ResultsPerDayRequest, referer string) (map[string]int, error) {
+func resultsPerDay(requests chan store.ResultsPerDayRequest, referer string, site int) (map[string]int, error) {
 	request := store.ResultsPerDayRequest{
 		Referer:  referer,
+		Site:     site,
 		Response: make(chan store.ResultsPerDayResponse),
 	}
 	requests <- request
@@ -92,9 +107,10 @@ func resultsPerDay(requests chan store.ResultsPerDayRequest, referer string) (ma
 	return response.Results, response.Err
 }
 
-func resultsPerCountry(requests chan store.ResultsPerCountryRequest, referer string) (map[string]int, error) {
+func resultsPerCountry(requests chan store.ResultsPerCountryRequest, referer string, site int) (map[string]int, error) {
 	request := store.ResultsPerCountryRequest{
 		Referer:  referer,
+		Site:     site,
 		Response: make(chan store.ResultsPerCountryResponse),
 	}
 	requests <- request
@@ -105,26 +121,51 @@ func resultsPerCountry(requests chan store.ResultsPerCountryRequest, referer str
 func (state *statsState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	statsHits.Inc(1)
 
-	referer := r.URL.Query().Get("referer")
-	refererString, err := formatReferer(referer)
-	if err != nil {
-		log.Printf("error formatting referer: %v", err)
-		refererString = ""
+	// Registered sites are looked up by key and only share statistics if
+	// they opted in. Other sites are looked up by referer.
+	var siteId int
+	var siteName, refererString string
+	if key := r.URL.Query().Get("site"); key != "" {
+		site, ok := state.Sites.Lookup(key)
+		if !ok {
+			http.Error(w, "no such site", http.StatusNotFound)
+			return
+		}
+		if !site.ShowStats {
+			statsNotSharedCount.Inc(1)
+			http.Error(w, "this site doesn't share its statistics", http.StatusForbidden)
+			return
+		}
+		siteId, siteName = site.Id, site.Name
+	} else {
+		siteName = r.URL.Query().Get("referer")
+		var err error
+		refererString, err = formatReferer(siteName)
+		if err != nil {
+			log.Printf("error formatting referer: %v", err)
+			refererString = ""
+		}
 	}
 
-	totalResults, err := countResults(state.CountResultsRequests, refererString)
+	totalResults, err := countResults(state.CountResultsRequests, refererString, siteId)
 	if err != nil {
 		log.Printf("error counting results for this referer: %s", err)
 		totalResults = 0
 	}
 
-	perDay, err := resultsPerDay(state.ResultsPerDayRequests, refererString)
+	optOuts, err := countResults(state.CountOptOutsRequests, refererString, siteId)
+	if err != nil {
+		log.Printf("error counting opt-outs for this referer: %s", err)
+		optOuts = 0
+	}
+
+	perDay, err := resultsPerDay(state.ResultsPerDayRequests, refererString, siteId)
 	if err != nil {
 		log.Printf("error counting results per day for this referer: %s", err)
 		perDay = map[string]int{}
 	}
 
-	perCountry, err := resultsPerCountry(state.ResultsPerCountryRequests, refererString)
+	perCountry, err := resultsPerCountry(state.ResultsPerCountryRequests, refererString, siteId)
 	if err != nil {
 		log.Printf("error counting results per country for this referer: %s", err)
 		perCountry = map[string]int{}
@@ -134,11 +175,13 @@ func (state *statsState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := encoder.Encode(struct {
 		Site              string
 		TotalResults      int
+		OptOuts           int
 		ResultsPerDay     map[string]int
 		ResultsPerCountry map[string]int
 	}{
-		Site:              referer,
+		Site:              siteName,
 		TotalResults:      totalResults,
+		OptOuts:           optOuts,
 		ResultsPerDay:     perDay,
 		ResultsPerCountry: perCountry,
 	}); err != nil {
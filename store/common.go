@@ -13,11 +13,61 @@ type Task struct {
 	Parameters map[string]sql.NullString
 }
 
+// TaskFunction is a row of task_functions. Zero MaxDurationSeconds,
+// MaxMeasurements and MaxRatePerSecond mean no limit, which is NULL in the
+// database. Stores fold Name to lower case.
+type TaskFunction struct {
+	Id                 int
+	Name               string
+	Priority           int
+	MaxDurationSeconds int
+	MaxMeasurements    int
+	MaxRatePerSecond   int
+	Weight             int
+	Enabled            bool
+	IncludeCountries   []string
+	ExcludeCountries   []string
+	CountryQuotas      map[string]int
+}
+
+// Schedule is a row of scheduled_functions. MeasurementsRemaining is nil for
+// schedules without a measurement budget and ExpirationTime is zero for
+// schedules that don't expire. Budgets lag behind served tasks by up to
+// -served_flush_interval.
+type Schedule struct {
+	Id                    int
+	TaskFunction          int
+	TaskFunctionName      string
+	Priority              int
+	ScheduledTime         time.Time
+	ExpirationTime        time.Time
+	MeasurementsRemaining *int64
+	CountryRemaining      map[string]int64
+}
+
+// Site is a row of sites: a Web site registered to embed tasks. Key is the
+// public site key that its pages pass to /task.js. Empty AllowedTaskTypes
+// allows every task type. Runtime picks the client templates its pages get,
+// such as "vanilla" for pages without jQuery; empty means the default.
+type Site struct {
+	Id               int
+	Key              string
+	Name             string
+	ContactEmail     string
+	AllowedTaskTypes []string
+	ShowStats        bool
+	Enabled          bool
+	Runtime          string
+}
+
 type TaskRequest struct {
 	Hints    map[string]string
 	Response chan *Task
 }
 
+// TemplateHash identifies the content of the template that rendered the
+// query and GitRevision the build of the server that served it. Site is 0 for
+// queries from pages of unregistered sites.
 type Query struct {
 	Id             int
 	Timestamp      time.Time
@@ -27,40 +77,87 @@ type Query struct {
 	Substrate      string
 	ParametersJson []byte
 	ResponseBody   []byte
+	TemplateHash   string
+	GitRevision    string
+	Site           int
 }
 
 type ParsedQuery struct {
-	Query          int
-	MeasurementId  string
-	Timestamp      time.Time
-	ClientIp       net.IP
-	ClientLocation string
-	Substrate      string
-	Parameters     map[string]sql.NullString
+	Query              int
+	MeasurementId      string
+	Timestamp          time.Time
+	ClientIp           net.IP
+	ClientLocation     string
+	ClientAsn          int
+	ClientOrganization string
+	ClientCity         string
+	Substrate          string
+	Parameters         map[string]sql.NullString
+	TemplateHash       string
+	GitRevision        string
+	Site               int
 }
 
+// Authenticated is whether the result carried a measurement id that we
+// signed. It is NULL for results recorded before we signed measurement ids,
+// which count as authenticated.
 type Result struct {
-	Id         int
-	Timestamp  time.Time
-	RemoteAddr string
-	RawRequest []byte
+	Id            int
+	Timestamp     time.Time
+	RemoteAddr    string
+	RawRequest    []byte
+	Authenticated sql.NullBool
+}
+
+// counts reports whether the result may be parsed and counted. Every backend
+// must agree with coalesce(authenticated, true).
+func (result *Result) counts() bool {
+	return !result.Authenticated.Valid || result.Authenticated.Bool
 }
 
+// The Timing fields are milliseconds from the Resource Timing API, which fetch
+// tasks report when the browser exposes them. They are NULL otherwise.
+// SubTarget identifies which target of a multi-target task the result is
+// for, such as "0" for its first target or "control"; it is empty for other
+// tasks.
 type ParsedResult struct {
-	Result         int
-	Timestamp      time.Time
-	MeasurementId  string
-	Outcome        string
-	Message        string
-	Origin         string
-	Referer        string
-	ClientIp       net.IP
-	ClientLocation string
-	UserAgent      string
+	Result             int
+	Timestamp          time.Time
+	MeasurementId      string
+	Outcome            string
+	Message            string
+	Origin             string
+	Referer            string
+	ClientIp           net.IP
+	ClientLocation     string
+	ClientAsn          int
+	ClientOrganization string
+	ClientCity         string
+	UserAgent          string
+	TimingDns          sql.NullInt64
+	TimingConnect      sql.NullInt64
+	TimingTls          sql.NullInt64
+	TimingRequest      sql.NullInt64
+	TimingResponse     sql.NullInt64
+	TimingDuration     sql.NullInt64
+	SubTarget          string
+}
+
+// OptOut records that we didn't measure a visitor to Referer because they
+// asked us not to. Reason is how they asked: "request" for the opt-out cookie
+// or hint, "gpc" for Sec-GPC or "dnt" for DNT.
+type OptOut struct {
+	Timestamp time.Time
+	Referer   string
+	Reason    string
+	Site      int
 }
 
+// Statistics requests with a non-zero Site count results of queries served to
+// that site, and ignore Referer.
 type CountResultsRequest struct {
 	Referer  string
+	Site     int
 	Response chan CountResultsResponse
 }
 
@@ -71,6 +168,7 @@ type CountResultsResponse struct {
 
 type ResultsPerDayRequest struct {
 	Referer  string
+	Site     int
 	Response chan ResultsPerDayResponse
 }
 
@@ -81,6 +179,7 @@ type ResultsPerDayResponse struct {
 
 type ResultsPerCountryRequest struct {
 	Referer  string
+	Site     int
 	Response chan ResultsPerCountryResponse
 }
 
@@ -91,40 +190,78 @@ type ResultsPerCountryResponse struct {
 
 type Store interface {
 	Close()
+	SchemaVersion() (int, error)
+	Migrate() error
 	ScheduleTaskFunctions()
+	TaskFunctions() ([]TaskFunction, error)
+	CreateTaskFunction(taskFunction TaskFunction) (int, error)
+	UpdateTaskFunction(taskFunction TaskFunction) error
+	ConcurrentFunctions() (int, error)
+	SetConcurrentFunctions(concurrentFunctions int) error
+	Schedules() ([]Schedule, error)
+	Sites() ([]Site, error)
+	CreateSite(site Site) (int, error)
+	UpdateSite(site Site) error
 	Tasks(<-chan *TaskRequest)
 	WriteTasks(tasks <-chan *Task)
+	AllTasks() <-chan *Task
+	InsertTasks(tasks []*Task) ([]int, error)
 	WriteQueries(queries <-chan *Query)
 	Queries() <-chan *Query
 	UnparsedQueries() <-chan *Query
 	WriteParsedQueries(queries <-chan *ParsedQuery)
 	WriteResults(results <-chan *Result)
 	Results() <-chan *Result
+	// UnparsedResults skips unauthenticated results, so they never reach
+	// parsed_results or the tables computed from it.
 	UnparsedResults() <-chan *Result
 	WriteParsedResults(results <-chan *ParsedResult)
+	WriteOptOuts(optOuts <-chan *OptOut)
 	CountResultsForReferrer(requests <-chan CountResultsRequest)
+	// CountOptOutsForReferrer answers with a zero count for referers and
+	// sites without opt-outs.
+	CountOptOutsForReferrer(requests <-chan CountResultsRequest)
 	ResultsPerDayForReferrer(requests <-chan ResultsPerDayRequest)
 	ResultsPerCountryForReferrer(requests <-chan ResultsPerCountryRequest)
 	ComputeResultsTables() error
 }
 
 var databaseDriver, databaseName string
+var migrateSchema bool
 
 func init() {
-	flag.StringVar(&databaseDriver, "driver", "postgres", "Database driver")
-	flag.StringVar(&databaseName, "database", "dbname=encore sslmode=disable", "Name or path of the database to use")
+	flag.StringVar(&databaseDriver, "driver", "postgres", "Database driver: postgres, sqlite3 or memory")
+	flag.StringVar(&databaseName, "database", "dbname=encore sslmode=disable", "Name or path of the database to use. The memory driver loads tasks from this path if it is a JSON file.")
+	flag.BoolVar(&migrateSchema, "migrate", false, "Apply pending schema migrations and exit")
 }
 
-func Open() Store {
+func openDatabase() *sql.DB {
 	db, err := sql.Open(databaseDriver, databaseName)
 	if err != nil {
 		log.Fatalf("error opening database %s: %v", databaseName, err)
 	}
+	return db
+}
+
+// Open connects to the database named by the -driver and -database flags. It
+// exits instead of returning a store whose schema is out of date.
+func Open() Store {
+	var s Store
 	switch databaseDriver {
 	case "postgres":
-		return openPostgres(db)
+		s = openPostgres(openDatabase())
+	case "sqlite3":
+		s = openSqlite(databaseName)
+	case "memory":
+		s = openMemory(databaseName)
 	default:
 		log.Fatalf("invalid database driver")
 	}
-	return nil
+
+	migrateIfAsked(s)
+
+	if err := checkSchemaVersion(s); err != nil {
+		log.Fatal(err)
+	}
+	return s
 }
@@ -0,0 +1,21 @@
+package store
+
+import (
+	"regexp"
+)
+
+const (
+	postgresDialect = "postgres"
+	sqliteDialect   = "sqlite3"
+)
+
+var postgresPlaceholder = regexp.MustCompile(`\$([0-9]+)`)
+
+// rebind rewrites a statement written with Postgres' $1 placeholders for the
+// given dialect. SQLite understands ?1.
+func rebind(dialect, statement string) string {
+	if dialect != sqliteDialect {
+		return statement
+	}
+	return postgresPlaceholder.ReplaceAllString(statement, "?$1")
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var schedulerInstance = flag.String("scheduler_instance", "", "Name of this instance in the SchedulerLeader metric. Defaults to the hostname and pid.")
+var schedulerLockKey = flag.Int64("scheduler_lock_key", 0x656e636f7265, "Postgres advisory lock key that instances sharing a database hold while they run the scheduler.")
+
+var schedulerLeadershipChangesCounter = metrics.GetOrRegisterCounter("SchedulerLeadershipChanges", nil)
+var schedulerLeaderErrorCounter = metrics.GetOrRegisterCounter("SchedulerLeaderError", nil)
+
+func schedulerInstanceName() string {
+	if *schedulerInstance != "" {
+		return *schedulerInstance
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// schedulerLeaderGauge is 1 while this instance runs the scheduler and 0
+// otherwise. Its name includes the instance so the leader can be identified.
+func schedulerLeaderGauge() metrics.Gauge {
+	return metrics.GetOrRegisterGauge(fmt.Sprintf("SchedulerLeader.%s", schedulerInstanceName()), nil)
+}
+
+// advisoryLockElection ensures that only one of several instances sharing a
+// Postgres database runs the scheduler. The leader holds a session-level
+// advisory lock on a dedicated connection. If the leader exits or loses its
+// connection, Postgres releases the lock and another instance acquires it the
+// next time it tries.
+type advisoryLockElection struct {
+	db      *sql.DB
+	conn    *sql.Conn
+	leading bool
+	gauge   metrics.Gauge
+}
+
+func newAdvisoryLockElection(db *sql.DB) *advisoryLockElection {
+	return &advisoryLockElection{
+		db:    db,
+		gauge: schedulerLeaderGauge(),
+	}
+}
+
+func (election *advisoryLockElection) setLeading(leading bool) {
+	if leading != election.leading {
+		if leading {
+			log.Printf("this instance is now the scheduler leader")
+		} else {
+			log.Printf("this instance is no longer the scheduler leader")
+		}
+		schedulerLeadershipChangesCounter.Inc(1)
+	}
+	election.leading = leading
+	if leading {
+		election.gauge.Update(1)
+	} else {
+		election.gauge.Update(0)
+	}
+}
+
+func (election *advisoryLockElection) dropConnection() {
+	if election.conn != nil {
+		election.conn.Close()
+		election.conn = nil
+	}
+	election.setLeading(false)
+}
+
+// lead reports whether this instance should run the scheduler now, trying to
+// become leader if it isn't already.
+func (election *advisoryLockElection) lead() bool {
+	ctx := context.Background()
+
+	if election.conn == nil {
+		conn, err := election.db.Conn(ctx)
+		if err != nil {
+			log.Printf("error opening scheduler leader connection: %v", err)
+			schedulerLeaderErrorCounter.Inc(1)
+			election.setLeading(false)
+			return false
+		}
+		election.conn = conn
+	}
+
+	if election.leading {
+		if _, err := election.conn.ExecContext(ctx, "SELECT 1"); err != nil {
+			log.Printf("lost scheduler leader connection: %v", err)
+			schedulerLeaderErrorCounter.Inc(1)
+			election.dropConnection()
+			return false
+		}
+		return true
+	}
+
+	var acquired bool
+	if err := election.conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", *schedulerLockKey).Scan(&acquired); err != nil {
+		log.Printf("error acquiring scheduler lock: %v", err)
+		schedulerLeaderErrorCounter.Inc(1)
+		election.dropConnection()
+		return false
+	}
+	election.setLeading(acquired)
+	return acquired
+}
@@ -0,0 +1,848 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in process memory. It's meant for unit tests
+// and for running Encore on a laptop without a database.
+type MemoryStore struct {
+	mutex               sync.Mutex
+	concurrentFunctions int
+	tasks               []*Task
+	taskFunctions       []*TaskFunction
+	scheduledFunctions  []*memoryScheduledFunction
+	lastScheduleId      int
+	queries             []*Query
+	parsedQueries       []*ParsedQuery
+	results             []*Result
+	parsedResults       []*ParsedResult
+	optOuts             []*OptOut
+	sites               []*Site
+	resultsPerReferer   map[statsKey]int
+	resultsPerDay       map[statsKey]map[string]int
+	resultsPerCountry   map[statsKey]map[string]int
+}
+
+// statsKey is the referer or site that statistics are grouped by.
+type statsKey struct {
+	Referer string
+	Site    int
+}
+
+func newStatsKey(referer string, site int) statsKey {
+	if site != 0 {
+		return statsKey{Site: site}
+	}
+	return statsKey{Referer: referer}
+}
+
+// memoryScheduledFunction is a schedule of the task function with id
+// taskFunction. Like the SQL stores, which join scheduled_functions with
+// task_functions, schedules see changes to their task function.
+type memoryScheduledFunction struct {
+	id                    int
+	taskFunction          int
+	expirationTime        time.Time
+	measurementsRemaining sql.NullInt64
+	countryRemaining      map[string]int64
+	priority              int
+	scheduledTime         time.Time
+}
+
+// memoryFixture is the format of the JSON file that seeds a MemoryStore when
+// running with -driver=memory.
+type memoryFixture struct {
+	ConcurrentFunctions int
+	TaskFunctions       []TaskFunction
+	Tasks               []map[string]string
+	Sites               []Site
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		resultsPerReferer: make(map[statsKey]int),
+		resultsPerDay:     make(map[statsKey]map[string]int),
+		resultsPerCountry: make(map[statsKey]map[string]int),
+	}
+}
+
+func openMemory(fixturePath string) Store {
+	store := NewMemoryStore()
+	if _, err := os.Stat(fixturePath); err != nil {
+		log.Printf("starting with an empty memory store")
+		return store
+	}
+	if err := store.loadFixture(fixturePath); err != nil {
+		log.Fatalf("error loading memory store fixture %s: %v", fixturePath, err)
+	}
+	return store
+}
+
+func (store *MemoryStore) loadFixture(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var fixture memoryFixture
+	if err := json.NewDecoder(f).Decode(&fixture); err != nil {
+		return err
+	}
+
+	store.SetConcurrentFunctions(fixture.ConcurrentFunctions)
+	for _, taskFunction := range fixture.TaskFunctions {
+		store.CreateTaskFunction(taskFunction)
+	}
+	for _, parameters := range fixture.Tasks {
+		task := Task{
+			Parameters: make(map[string]sql.NullString),
+		}
+		for k, v := range parameters {
+			task.Parameters[k] = sql.NullString{
+				String: v,
+				Valid:  true,
+			}
+		}
+		store.addTask(&task)
+	}
+	for _, site := range fixture.Sites {
+		if _, err := store.CreateSite(site); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TaskFunctions returns copies of the task functions, ordered by id.
+func (store *MemoryStore) TaskFunctions() ([]TaskFunction, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var taskFunctions []TaskFunction
+	for _, taskFunction := range store.taskFunctions {
+		taskFunctions = append(taskFunctions, copyTaskFunction(taskFunction))
+	}
+	return taskFunctions, nil
+}
+
+// CreateTaskFunction is the equivalent of inserting a row into task_functions.
+// The Name must have been registered with RegisterTaskFilter. It returns the
+// id of the new task function.
+func (store *MemoryStore) CreateTaskFunction(taskFunction TaskFunction) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	taskFunction.Id = len(store.taskFunctions) + 1
+	taskFunction.Name = NormalizeTaskFunctionName(taskFunction.Name)
+	copied := copyTaskFunction(&taskFunction)
+	store.taskFunctions = append(store.taskFunctions, &copied)
+	return taskFunction.Id, nil
+}
+
+// UpdateTaskFunction replaces the task function with the same Id. Like the
+// SQL stores, existing schedules keep their priority and budgets but pick up
+// the new name, rate, weight and countries.
+func (store *MemoryStore) UpdateTaskFunction(taskFunction TaskFunction) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	taskFunction.Name = NormalizeTaskFunctionName(taskFunction.Name)
+	for i, existing := range store.taskFunctions {
+		if existing.Id == taskFunction.Id {
+			copied := copyTaskFunction(&taskFunction)
+			store.taskFunctions[i] = &copied
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func copyTaskFunction(taskFunction *TaskFunction) TaskFunction {
+	copied := *taskFunction
+	copied.IncludeCountries = append([]string(nil), taskFunction.IncludeCountries...)
+	copied.ExcludeCountries = append([]string(nil), taskFunction.ExcludeCountries...)
+	if taskFunction.CountryQuotas != nil {
+		copied.CountryQuotas = make(map[string]int)
+		for country, quota := range taskFunction.CountryQuotas {
+			copied.CountryQuotas[country] = quota
+		}
+	}
+	return copied
+}
+
+func (store *MemoryStore) ConcurrentFunctions() (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.concurrentFunctions, nil
+}
+
+// SetConcurrentFunctions is the equivalent of updating scheduler_configuration.
+func (store *MemoryStore) SetConcurrentFunctions(concurrentFunctions int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.concurrentFunctions = concurrentFunctions
+	return nil
+}
+
+// lookupTaskFunction returns the task function with id. Callers must hold
+// the mutex.
+func (store *MemoryStore) lookupTaskFunction(id int) *TaskFunction {
+	for _, taskFunction := range store.taskFunctions {
+		if taskFunction.Id == id {
+			return taskFunction
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) Schedules() ([]Schedule, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var schedules []Schedule
+	for _, scheduled := range store.scheduledFunctions {
+		schedule := Schedule{
+			Id:               scheduled.id,
+			TaskFunction:     scheduled.taskFunction,
+			TaskFunctionName: store.lookupTaskFunction(scheduled.taskFunction).Name,
+			Priority:         scheduled.priority,
+			ScheduledTime:    scheduled.scheduledTime,
+			ExpirationTime:   scheduled.expirationTime,
+			CountryRemaining: make(map[string]int64),
+		}
+		if scheduled.measurementsRemaining.Valid {
+			remaining := scheduled.measurementsRemaining.Int64
+			schedule.MeasurementsRemaining = &remaining
+		}
+		for country, remaining := range scheduled.countryRemaining {
+			schedule.CountryRemaining[country] = remaining
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
+func copySite(site *Site) Site {
+	copied := *site
+	copied.AllowedTaskTypes = append([]string(nil), site.AllowedTaskTypes...)
+	return copied
+}
+
+// Sites returns copies of the registered sites, ordered by id.
+func (store *MemoryStore) Sites() ([]Site, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var sites []Site
+	for _, site := range store.sites {
+		sites = append(sites, copySite(site))
+	}
+	return sites, nil
+}
+
+// CreateSite is the equivalent of inserting a row into sites. Like the SQL
+// stores, it refuses duplicate keys.
+func (store *MemoryStore) CreateSite(site Site) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, existing := range store.sites {
+		if existing.Key == site.Key {
+			return 0, fmt.Errorf("site key %q is already registered", site.Key)
+		}
+	}
+	site.Id = len(store.sites) + 1
+	site.AllowedTaskTypes = normalizeTaskTypes(site.AllowedTaskTypes)
+	copied := copySite(&site)
+	store.sites = append(store.sites, &copied)
+	return site.Id, nil
+}
+
+func (store *MemoryStore) UpdateSite(site Site) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, existing := range store.sites {
+		if existing.Id != site.Id && existing.Key == site.Key {
+			return fmt.Errorf("site key %q is already registered", site.Key)
+		}
+	}
+	for _, existing := range store.sites {
+		if existing.Id == site.Id {
+			site.AllowedTaskTypes = normalizeTaskTypes(site.AllowedTaskTypes)
+			*existing = copySite(&site)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (store *MemoryStore) Close() {
+}
+
+// SchemaVersion is always current because a MemoryStore has no schema.
+func (store *MemoryStore) SchemaVersion() (int, error) {
+	return LatestSchemaVersion, nil
+}
+
+func (store *MemoryStore) Migrate() error {
+	return nil
+}
+
+func (store *MemoryStore) insertTaskFunctions(now time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var minTaskFunction, minPriority int
+	if len(store.scheduledFunctions) == 0 {
+		log.Printf("no prior functions scheduled")
+		noPriorFunctionsScheduledCounter.Inc(1)
+	} else {
+		last := store.scheduledFunctions[0]
+		for _, scheduled := range store.scheduledFunctions[1:] {
+			if scheduled.scheduledTime.After(last.scheduledTime) ||
+				(scheduled.scheduledTime.Equal(last.scheduledTime) && scheduled.priority > last.priority) ||
+				(scheduled.scheduledTime.Equal(last.scheduledTime) && scheduled.priority == last.priority && scheduled.taskFunction > last.taskFunction) {
+				last = scheduled
+			}
+		}
+		minTaskFunction, minPriority = last.taskFunction, last.priority
+	}
+
+	log.Printf("min task function: %v, min priority: %v", minTaskFunction, minPriority)
+
+	var unexpired []*memoryScheduledFunction
+	for _, scheduled := range store.scheduledFunctions {
+		if !scheduled.expirationTime.IsZero() && scheduled.expirationTime.Before(now) {
+			continue
+		}
+		if scheduled.measurementsRemaining.Valid && scheduled.measurementsRemaining.Int64 <= 0 {
+			continue
+		}
+		taskFunction := store.lookupTaskFunction(scheduled.taskFunction)
+		if !taskFunction.Enabled {
+			continue
+		}
+		if quotasExhausted(normalizeCountries(taskFunction.IncludeCountries), scheduled.countryRemaining) {
+			continue
+		}
+		unexpired = append(unexpired, scheduled)
+	}
+	store.scheduledFunctions = unexpired
+
+	toSchedule := store.concurrentFunctions - len(store.scheduledFunctions)
+
+	var enabled []*TaskFunction
+	for _, taskFunction := range store.taskFunctions {
+		if taskFunction.Enabled {
+			enabled = append(enabled, taskFunction)
+		}
+	}
+	sort.Sort(taskFunctionsByPriority(enabled))
+
+	schedule := func(taskFunction *TaskFunction) {
+		countryRemaining := make(map[string]int64)
+		for country, measurements := range taskFunction.CountryQuotas {
+			countryRemaining[normalizeCountry(country)] = int64(measurements)
+		}
+		var expirationTime time.Time
+		if taskFunction.MaxDurationSeconds != 0 {
+			expirationTime = now.Add(time.Duration(taskFunction.MaxDurationSeconds) * time.Second)
+		}
+		store.lastScheduleId++
+		store.scheduledFunctions = append(store.scheduledFunctions, &memoryScheduledFunction{
+			id:                    store.lastScheduleId,
+			taskFunction:          taskFunction.Id,
+			expirationTime:        expirationTime,
+			measurementsRemaining: nullIfZero(taskFunction.MaxMeasurements),
+			countryRemaining:      countryRemaining,
+			priority:              taskFunction.Priority,
+			scheduledTime:         now,
+		})
+		toSchedule--
+	}
+	for _, taskFunction := range enabled {
+		if toSchedule <= 0 {
+			break
+		}
+		if (taskFunction.Priority == minPriority && taskFunction.Id > minTaskFunction) || taskFunction.Priority > minPriority {
+			schedule(taskFunction)
+		}
+	}
+	for _, taskFunction := range enabled {
+		if toSchedule <= 0 {
+			break
+		}
+		schedule(taskFunction)
+	}
+	if toSchedule > 0 {
+		log.Printf("unable to fill schedule")
+		unfilledScheduleCounter.Inc(1)
+	}
+}
+
+type taskFunctionsByPriority []*TaskFunction
+
+func (s taskFunctionsByPriority) Len() int      { return len(s) }
+func (s taskFunctionsByPriority) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s taskFunctionsByPriority) Less(i, j int) bool {
+	if s[i].Priority != s[j].Priority {
+		return s[i].Priority < s[j].Priority
+	}
+	return s[i].Id < s[j].Id
+}
+
+func (store *MemoryStore) ScheduleTaskFunctions() {
+	schedulerLeaderGauge().Update(1)
+	store.insertTaskFunctions(time.Now())
+	for _ = range time.Tick(*schedulingInterval) {
+		store.insertTaskFunctions(time.Now())
+	}
+}
+
+func (store *MemoryStore) currentTaskFunctions() []scheduledTaskFunction {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var taskFunctions []scheduledTaskFunction
+	for _, scheduled := range store.scheduledFunctions {
+		if scheduled.measurementsRemaining.Valid && scheduled.measurementsRemaining.Int64 <= 0 {
+			continue
+		}
+		taskFunction := store.lookupTaskFunction(scheduled.taskFunction)
+		if !taskFunction.Enabled {
+			continue
+		}
+		countryRemaining := make(map[string]int64)
+		for country, remaining := range scheduled.countryRemaining {
+			countryRemaining[country] = remaining
+		}
+		taskFunctions = append(taskFunctions, scheduledTaskFunction{
+			ScheduleId:            scheduled.id,
+			Id:                    taskFunction.Id,
+			Name:                  taskFunction.Name,
+			MaxRatePerSecond:      taskFunction.MaxRatePerSecond,
+			Weight:                taskFunction.Weight,
+			MeasurementsRemaining: scheduled.measurementsRemaining,
+			IncludeCountries:      normalizeCountries(taskFunction.IncludeCountries),
+			ExcludeCountries:      normalizeCountries(taskFunction.ExcludeCountries),
+			CountryRemaining:      countryRemaining,
+		})
+	}
+	sort.Sort(scheduledTaskFunctionsById(taskFunctions))
+	return taskFunctions
+}
+
+func (store *MemoryStore) writeServed(served servedCounts) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, scheduled := range store.scheduledFunctions {
+		if scheduled.measurementsRemaining.Valid {
+			scheduled.measurementsRemaining.Int64 -= int64(served.Total[scheduled.id])
+		}
+		for country, count := range served.ByCountry[scheduled.id] {
+			scheduled.countryRemaining[country] -= int64(count)
+		}
+	}
+}
+
+type scheduledTaskFunctionsById []scheduledTaskFunction
+
+func (s scheduledTaskFunctionsById) Len() int           { return len(s) }
+func (s scheduledTaskFunctionsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s scheduledTaskFunctionsById) Less(i, j int) bool { return s[i].Id < s[j].Id }
+
+func (store *MemoryStore) selectTask(taskFunction string, hints map[string]string) *Task {
+	filter, ok := lookupTaskFilter(taskFunction)
+	if !ok {
+		log.Printf("no task filter registered for task function %q", taskFunction)
+		return nil
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var candidates []*Task
+	for _, task := range store.tasks {
+		if filter(task, hints) && taskTypeAllowed(task, hints) {
+			candidates = append(candidates, task)
+		}
+	}
+	if len(candidates) == 0 {
+		emptyTaskFunctionCounter.Inc(1)
+		return nil
+	}
+	return copyTask(candidates[rand.Intn(len(candidates))])
+}
+
+func copyTask(task *Task) *Task {
+	parameters := make(map[string]sql.NullString)
+	for k, v := range task.Parameters {
+		parameters[k] = v
+	}
+	return &Task{
+		Id:         task.Id,
+		Parameters: parameters,
+	}
+}
+
+func (store *MemoryStore) Tasks(taskRequests <-chan *TaskRequest) {
+	updateTicker := time.Tick(*schedulingInterval)
+	flushTicker := time.Tick(*servedFlushInterval)
+
+	selector := newTaskFunctionSelector(store.currentTaskFunctions(), newSchedulingRand())
+	writeCounts := func(served servedCounts) error {
+		store.writeServed(served)
+		return nil
+	}
+	readSchedules := func() ([]scheduledTaskFunction, error) {
+		return store.currentTaskFunctions(), nil
+	}
+	for {
+		select {
+		case taskRequest := <-taskRequests:
+			task := selector.serve(time.Now(), taskRequest.Hints, func(taskFunction string) *Task {
+				return store.selectTask(taskFunction, taskRequest.Hints)
+			})
+			select {
+			case taskRequest.Response <- task:
+			case <-time.After(time.Second):
+				log.Printf("task response timed out")
+			}
+			close(taskRequest.Response)
+
+		case <-flushTicker:
+			selector.flush(writeCounts, readSchedules)
+
+		case <-updateTicker:
+			selector.flush(writeCounts, readSchedules)
+		}
+	}
+}
+
+func (store *MemoryStore) addTask(task *Task) int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stored := copyTask(task)
+	stored.Id = len(store.tasks) + 1
+	store.tasks = append(store.tasks, stored)
+	return stored.Id
+}
+
+func (store *MemoryStore) WriteTasks(tasks <-chan *Task) {
+	for task := range tasks {
+		store.addTask(task)
+	}
+}
+
+func (store *MemoryStore) AllTasks() <-chan *Task {
+	store.mutex.Lock()
+	var selected []*Task
+	for _, task := range store.tasks {
+		selected = append(selected, copyTask(task))
+	}
+	store.mutex.Unlock()
+
+	tasks := make(chan *Task)
+	go func() {
+		defer close(tasks)
+		for _, task := range selected {
+			tasks <- task
+		}
+	}()
+	return tasks
+}
+
+func (store *MemoryStore) InsertTasks(tasks []*Task) ([]int, error) {
+	var ids []int
+	for _, task := range tasks {
+		ids = append(ids, store.addTask(task))
+	}
+	return ids, nil
+}
+
+func (store *MemoryStore) WriteQueries(queries <-chan *Query) {
+	for query := range queries {
+		stored := *query
+		store.mutex.Lock()
+		stored.Id = len(store.queries) + 1
+		store.queries = append(store.queries, &stored)
+		store.mutex.Unlock()
+	}
+}
+
+// selectQueries copies the queries matching a predicate so they can be sent
+// on a channel without holding the lock.
+func (store *MemoryStore) selectQueries(include func(*Query) bool) []*Query {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var selected []*Query
+	for _, query := range store.queries {
+		if include(query) {
+			copied := *query
+			selected = append(selected, &copied)
+		}
+	}
+	return selected
+}
+
+func (store *MemoryStore) Queries() <-chan *Query {
+	selected := store.selectQueries(func(*Query) bool { return true })
+	queries := make(chan *Query)
+	go func() {
+		defer close(queries)
+		for _, query := range selected {
+			queries <- query
+		}
+	}()
+	return queries
+}
+
+func (store *MemoryStore) UnparsedQueries() <-chan *Query {
+	store.mutex.Lock()
+	parsed := make(map[int]bool)
+	for _, parsedQuery := range store.parsedQueries {
+		parsed[parsedQuery.Query] = true
+	}
+	store.mutex.Unlock()
+
+	selected := store.selectQueries(func(query *Query) bool { return !parsed[query.Id] })
+	queries := make(chan *Query)
+	go func() {
+		defer close(queries)
+		for _, query := range selected {
+			queries <- query
+		}
+	}()
+	return queries
+}
+
+func (store *MemoryStore) WriteParsedQueries(parsedQueries <-chan *ParsedQuery) {
+	for parsedQuery := range parsedQueries {
+		stored := *parsedQuery
+		store.mutex.Lock()
+		store.parsedQueries = append(store.parsedQueries, &stored)
+		store.mutex.Unlock()
+	}
+}
+
+func (store *MemoryStore) WriteResults(results <-chan *Result) {
+	for result := range results {
+		stored := *result
+		store.mutex.Lock()
+		stored.Id = len(store.results) + 1
+		store.results = append(store.results, &stored)
+		store.mutex.Unlock()
+	}
+}
+
+// selectResults copies the results matching a predicate so they can be sent
+// on a channel without holding the lock.
+func (store *MemoryStore) selectResults(include func(*Result) bool) []*Result {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var selected []*Result
+	for _, result := range store.results {
+		if include(result) {
+			copied := *result
+			selected = append(selected, &copied)
+		}
+	}
+	return selected
+}
+
+func (store *MemoryStore) Results() <-chan *Result {
+	selected := store.selectResults(func(*Result) bool { return true })
+	results := make(chan *Result)
+	go func() {
+		defer close(results)
+		for _, result := range selected {
+			results <- result
+		}
+	}()
+	return results
+}
+
+func (store *MemoryStore) UnparsedResults() <-chan *Result {
+	store.mutex.Lock()
+	parsed := make(map[int]bool)
+	for _, parsedResult := range store.parsedResults {
+		parsed[parsedResult.Result] = true
+	}
+	store.mutex.Unlock()
+
+	selected := store.selectResults(func(result *Result) bool { return result.counts() && !parsed[result.Id] })
+	results := make(chan *Result)
+	go func() {
+		defer close(results)
+		for _, result := range selected {
+			results <- result
+		}
+	}()
+	return results
+}
+
+func (store *MemoryStore) WriteParsedResults(parsedResults <-chan *ParsedResult) {
+	for parsedResult := range parsedResults {
+		stored := *parsedResult
+		store.mutex.Lock()
+		store.parsedResults = append(store.parsedResults, &stored)
+		store.mutex.Unlock()
+	}
+}
+
+func (store *MemoryStore) WriteOptOuts(optOuts <-chan *OptOut) {
+	for optOut := range optOuts {
+		stored := *optOut
+		store.mutex.Lock()
+		store.optOuts = append(store.optOuts, &stored)
+		store.mutex.Unlock()
+	}
+}
+
+func (store *MemoryStore) ComputeResultsTables() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Results belong to the site of the query that gave out their
+	// measurement id.
+	sites := make(map[string]int)
+	for _, parsedQuery := range store.parsedQueries {
+		if parsedQuery.Site != 0 {
+			sites[parsedQuery.MeasurementId] = parsedQuery.Site
+		}
+	}
+
+	perReferer := make(map[statsKey]map[string]bool)
+	perDay := make(map[statsKey]map[string]map[string]bool)
+	perCountry := make(map[statsKey]map[string]map[string]bool)
+	addMeasurement := func(groups map[statsKey]map[string]map[string]bool, group statsKey, key, measurementId string) {
+		if groups[group] == nil {
+			groups[group] = make(map[string]map[string]bool)
+		}
+		if groups[group][key] == nil {
+			groups[group][key] = make(map[string]bool)
+		}
+		groups[group][key][measurementId] = true
+	}
+	for _, parsedResult := range store.parsedResults {
+		if parsedResult.Outcome != "init" {
+			continue
+		}
+		resultGroups := []statsKey{newStatsKey(parsedResult.Referer, 0)}
+		if site, ok := sites[parsedResult.MeasurementId]; ok {
+			resultGroups = append(resultGroups, newStatsKey("", site))
+		}
+		for _, group := range resultGroups {
+			if perReferer[group] == nil {
+				perReferer[group] = make(map[string]bool)
+			}
+			perReferer[group][parsedResult.MeasurementId] = true
+			addMeasurement(perDay, group, parsedResult.Timestamp.Format("2006-01-02"), parsedResult.MeasurementId)
+			addMeasurement(perCountry, group, parsedResult.ClientLocation, parsedResult.MeasurementId)
+		}
+	}
+
+	countGroups := func(groups map[statsKey]map[string]map[string]bool) map[statsKey]map[string]int {
+		counts := make(map[statsKey]map[string]int)
+		for group, keys := range groups {
+			counts[group] = make(map[string]int)
+			for key, measurementIds := range keys {
+				counts[group][key] = len(measurementIds)
+			}
+		}
+		return counts
+	}
+
+	store.resultsPerReferer = make(map[statsKey]int)
+	for group, measurementIds := range perReferer {
+		store.resultsPerReferer[group] = len(measurementIds)
+	}
+	store.resultsPerDay = countGroups(perDay)
+	store.resultsPerCountry = countGroups(perCountry)
+
+	return nil
+}
+
+func (store *MemoryStore) CountResultsForReferrer(requests <-chan CountResultsRequest) {
+	for request := range requests {
+		store.mutex.Lock()
+		count, ok := store.resultsPerReferer[newStatsKey(request.Referer, request.Site)]
+		store.mutex.Unlock()
+		if !ok {
+			request.Response <- CountResultsResponse{
+				Err: sql.ErrNoRows,
+			}
+			continue
+		}
+		request.Response <- CountResultsResponse{
+			Count: count,
+			Err:   nil,
+		}
+	}
+}
+
+func (store *MemoryStore) CountOptOutsForReferrer(requests <-chan CountResultsRequest) {
+	for request := range requests {
+		count := 0
+		store.mutex.Lock()
+		for _, optOut := range store.optOuts {
+			if request.Site != 0 && optOut.Site == request.Site || request.Site == 0 && optOut.Referer == request.Referer {
+				count++
+			}
+		}
+		store.mutex.Unlock()
+		request.Response <- CountResultsResponse{
+			Count: count,
+			Err:   nil,
+		}
+	}
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	copied := make(map[string]int)
+	for k, v := range counts {
+		copied[k] = v
+	}
+	return copied
+}
+
+func (store *MemoryStore) ResultsPerDayForReferrer(requests <-chan ResultsPerDayRequest) {
+	for request := range requests {
+		store.mutex.Lock()
+		results := copyCounts(store.resultsPerDay[newStatsKey(request.Referer, request.Site)])
+		store.mutex.Unlock()
+		request.Response <- ResultsPerDayResponse{
+			Results: results,
+			Err:     nil,
+		}
+	}
+}
+
+func (store *MemoryStore) ResultsPerCountryForReferrer(requests <-chan ResultsPerCountryRequest) {
+	for request := range requests {
+		store.mutex.Lock()
+		results := copyCounts(store.resultsPerCountry[newStatsKey(request.Referer, request.Site)])
+		store.mutex.Unlock()
+		request.Response <- ResultsPerCountryResponse{
+			Results: results,
+			Err:     nil,
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryUpdateTaskFunctionUpdatesSchedules(t *testing.T) {
+	store := NewMemoryStore()
+	store.SetConcurrentFunctions(1)
+	id, err := store.CreateTaskFunction(TaskFunction{
+		Name:             "all_tasks",
+		Priority:         1,
+		MaxRatePerSecond: 5,
+		Weight:           1,
+		Enabled:          true,
+	})
+	if err != nil {
+		t.Fatalf("error creating task function: %v", err)
+	}
+	store.insertTaskFunctions(time.Now())
+
+	if err := store.UpdateTaskFunction(TaskFunction{
+		Id:               id,
+		Name:             "all_tasks",
+		Priority:         2,
+		MaxRatePerSecond: 10,
+		Weight:           3,
+		IncludeCountries: []string{"us"},
+		Enabled:          true,
+	}); err != nil {
+		t.Fatalf("error updating task function: %v", err)
+	}
+
+	// Like the SQL stores, the schedule keeps the priority it was made with
+	// but sees the new rate, weight and countries.
+	schedules, err := store.Schedules()
+	if err != nil {
+		t.Fatalf("error listing schedules: %v", err)
+	}
+	if len(schedules) != 1 || schedules[0].Priority != 1 {
+		t.Fatalf("schedules = %+v, want one with priority 1", schedules)
+	}
+	current := store.currentTaskFunctions()
+	if len(current) != 1 || current[0].MaxRatePerSecond != 10 || current[0].Weight != 3 || !reflect.DeepEqual(current[0].IncludeCountries, []string{"US"}) {
+		t.Errorf("scheduled functions = %+v, want the new rate, weight and countries", current)
+	}
+}
+
+// scheduleStores returns a memory and a sqlite store, each with a function
+// that runs its scheduler and one that reads schedules like its Tasks loop.
+func scheduleStores(t *testing.T) (map[string]Store, map[string]func(), map[string]func() []scheduledTaskFunction, func()) {
+	dir, err := ioutil.TempDir("", "encore-store")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	sqlite := openSqlite(filepath.Join(dir, "encore.db")).(*sqliteStore)
+	if err := sqlite.Migrate(); err != nil {
+		t.Fatalf("error migrating sqlite store: %v", err)
+	}
+	memory := NewMemoryStore()
+
+	stores := map[string]Store{"memory": memory, "sqlite": sqlite}
+	schedulers := map[string]func(){
+		"memory": func() { memory.insertTaskFunctions(time.Now()) },
+		"sqlite": func() {
+			tx, err := sqlite.db.Begin()
+			if err != nil {
+				t.Fatalf("error starting transaction: %v", err)
+			}
+			if err := insertSqliteTaskFunctions(tx, time.Now()); err != nil {
+				t.Fatalf("error scheduling task functions: %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("error committing schedule: %v", err)
+			}
+		},
+	}
+	readers := map[string]func() []scheduledTaskFunction{
+		"memory": memory.currentTaskFunctions,
+		"sqlite": func() []scheduledTaskFunction {
+			functions, err := selectScheduledTaskFunctions(sqlite.db)
+			if err != nil {
+				t.Fatalf("error selecting schedules: %v", err)
+			}
+			return functions
+		},
+	}
+	cleanup := func() {
+		sqlite.Close()
+		os.RemoveAll(dir)
+	}
+	return stores, schedulers, readers, cleanup
+}
+
+func TestDisableStopsServingSchedules(t *testing.T) {
+	stores, schedulers, readers, cleanup := scheduleStores(t)
+	defer cleanup()
+
+	for name, s := range stores {
+		if err := s.SetConcurrentFunctions(1); err != nil {
+			t.Fatalf("%s: error setting concurrent functions: %v", name, err)
+		}
+		// Neither function has a duration or budget, so only disabling
+		// ends their schedules.
+		campaign, err := s.CreateTaskFunction(TaskFunction{Name: "all_tasks", Priority: 1, Weight: 1, Enabled: true})
+		if err != nil {
+			t.Fatalf("%s: error creating task function: %v", name, err)
+		}
+		if _, err := s.CreateTaskFunction(TaskFunction{Name: "other_tasks", Priority: 2, Weight: 1, Enabled: true}); err != nil {
+			t.Fatalf("%s: error creating task function: %v", name, err)
+		}
+		schedulers[name]()
+		if functions := readers[name](); len(functions) != 1 || functions[0].Name != "all_tasks" {
+			t.Fatalf("%s: scheduled functions = %+v, want all_tasks", name, functions)
+		}
+
+		if err := s.UpdateTaskFunction(TaskFunction{Id: campaign, Name: "all_tasks", Priority: 1, Weight: 1, Enabled: false}); err != nil {
+			t.Fatalf("%s: error disabling task function: %v", name, err)
+		}
+		if functions := readers[name](); len(functions) != 0 {
+			t.Errorf("%s: disabled function is still served: %+v", name, functions)
+		}
+
+		// The next scheduler run gives its slot to another function.
+		schedulers[name]()
+		schedules, err := s.Schedules()
+		if err != nil {
+			t.Fatalf("%s: error listing schedules: %v", name, err)
+		}
+		if len(schedules) != 1 || schedules[0].TaskFunctionName != "other_tasks" {
+			t.Errorf("%s: schedules = %+v, want only other_tasks", name, schedules)
+		}
+	}
+}
+
+// pipelineCounts are how many results runPipeline parsed and what the
+// statistics endpoints reported afterwards. UnknownRefererErr is whether
+// counting results for a referer without any failed, as it does in SQL.
+type pipelineCounts struct {
+	Unparsed          int
+	Reparsed          int
+	Referer           int
+	Site              int
+	PerDay            map[string]int
+	PerCountry        map[string]int
+	SitePerDay        map[string]int
+	SitePerCountry    map[string]int
+	UnknownRefererErr bool
+}
+
+// runPipeline serves a task and pushes three of its queries and three results, one each
+// with authenticated NULL, true and false, through s the way the server and
+// encore-parser do. schedule schedules the store's task functions.
+func runPipeline(t *testing.T, s Store, schedule func()) pipelineCounts {
+	if err := s.SetConcurrentFunctions(1); err != nil {
+		t.Fatalf("error setting concurrent functions: %v", err)
+	}
+	if _, err := s.CreateTaskFunction(TaskFunction{Name: "all_tasks", Priority: 1, Enabled: true}); err != nil {
+		t.Fatalf("error creating task function: %v", err)
+	}
+	if _, err := s.InsertTasks([]*Task{testTask(0, "img")}); err != nil {
+		t.Fatalf("error inserting tasks: %v", err)
+	}
+	schedule()
+
+	taskRequests := make(chan *TaskRequest)
+	go s.Tasks(taskRequests)
+	response := make(chan *Task, 1)
+	taskRequests <- &TaskRequest{Hints: map[string]string{}, Response: response}
+	task := <-response
+	if task == nil {
+		t.Fatalf("Tasks gave no task")
+	}
+
+	now := time.Date(2015, 3, 14, 15, 9, 26, 0, time.UTC)
+	queries := make(chan *Query, 3)
+	for i := 0; i < 3; i++ {
+		queries <- &Query{Timestamp: now, RemoteAddr: "192.0.2.1", Task: task.Id, Site: 7}
+	}
+	close(queries)
+	s.WriteQueries(queries)
+
+	results := make(chan *Result, 3)
+	for _, authenticated := range []sql.NullBool{{}, {Bool: true, Valid: true}, {Bool: false, Valid: true}} {
+		results <- &Result{Timestamp: now, RemoteAddr: "192.0.2.1", Authenticated: authenticated}
+	}
+	close(results)
+	s.WriteResults(results)
+
+	// Each query gave out the measurement id of the result with its id.
+	parsedQueries := make(chan *ParsedQuery, 3)
+	for query := range s.UnparsedQueries() {
+		parsedQueries <- &ParsedQuery{
+			Query:          query.Id,
+			MeasurementId:  fmt.Sprintf("m%d", query.Id),
+			Timestamp:      now,
+			ClientIp:       net.ParseIP("192.0.2.1"),
+			ClientLocation: "US",
+			Site:           7,
+		}
+	}
+	close(parsedQueries)
+	s.WriteParsedQueries(parsedQueries)
+
+	var counts pipelineCounts
+	parsedResults := make(chan *ParsedResult, 3)
+	for result := range s.UnparsedResults() {
+		counts.Unparsed++
+		parsedResults <- &ParsedResult{
+			Result:         result.Id,
+			Timestamp:      now,
+			MeasurementId:  fmt.Sprintf("m%d", result.Id),
+			Outcome:        "init",
+			Referer:        "http://example.com/",
+			ClientIp:       net.ParseIP("192.0.2.1"),
+			ClientLocation: "US",
+		}
+	}
+	close(parsedResults)
+	s.WriteParsedResults(parsedResults)
+	for _ = range s.UnparsedResults() {
+		counts.Reparsed++
+	}
+
+	if err := s.ComputeResultsTables(); err != nil {
+		t.Fatalf("error computing results tables: %v", err)
+	}
+
+	countRequests := make(chan CountResultsRequest)
+	go s.CountResultsForReferrer(countRequests)
+	count := func(referer string, site int) (int, error) {
+		response := make(chan CountResultsResponse)
+		countRequests <- CountResultsRequest{Referer: referer, Site: site, Response: response}
+		answer := <-response
+		return answer.Count, answer.Err
+	}
+	var err error
+	if counts.Referer, err = count("http://example.com/", 0); err != nil {
+		t.Errorf("error counting results for referer: %v", err)
+	}
+	if counts.Site, err = count("", 7); err != nil {
+		t.Errorf("error counting results for site: %v", err)
+	}
+	_, err = count("http://unknown.example.com/", 0)
+	counts.UnknownRefererErr = err != nil
+	close(countRequests)
+
+	dayRequests := make(chan ResultsPerDayRequest)
+	go s.ResultsPerDayForReferrer(dayRequests)
+	perDay := func(referer string, site int) map[string]int {
+		response := make(chan ResultsPerDayResponse)
+		dayRequests <- ResultsPerDayRequest{Referer: referer, Site: site, Response: response}
+		return (<-response).Results
+	}
+	counts.PerDay = perDay("http://example.com/", 0)
+	counts.SitePerDay = perDay("", 7)
+	close(dayRequests)
+
+	countryRequests := make(chan ResultsPerCountryRequest)
+	go s.ResultsPerCountryForReferrer(countryRequests)
+	perCountry := func(referer string, site int) map[string]int {
+		response := make(chan ResultsPerCountryResponse)
+		countryRequests <- ResultsPerCountryRequest{Referer: referer, Site: site, Response: response}
+		return (<-response).Results
+	}
+	counts.PerCountry = perCountry("http://example.com/", 0)
+	counts.SitePerCountry = perCountry("", 7)
+	close(countryRequests)
+
+	return counts
+}
+
+func TestMemoryPipelineMatchesSqlite(t *testing.T) {
+	memory := NewMemoryStore()
+	memoryCounts := runPipeline(t, memory, func() {
+		memory.insertTaskFunctions(time.Now())
+	})
+
+	dir, err := ioutil.TempDir("", "encore-store")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sqlite := openSqlite(filepath.Join(dir, "encore.db")).(*sqliteStore)
+	defer sqlite.Close()
+	if err := sqlite.Migrate(); err != nil {
+		t.Fatalf("error migrating sqlite store: %v", err)
+	}
+	sqliteCounts := runPipeline(t, sqlite, func() {
+		tx, err := sqlite.db.Begin()
+		if err != nil {
+			t.Fatalf("error starting transaction: %v", err)
+		}
+		if err := insertSqliteTaskFunctions(tx, time.Now()); err != nil {
+			t.Fatalf("error scheduling task functions: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing schedule: %v", err)
+		}
+	})
+
+	// The NULL and true results count; the false one never reaches
+	// parsed_results.
+	want := pipelineCounts{
+		Unparsed:          2,
+		Reparsed:          0,
+		Referer:           2,
+		Site:              2,
+		PerDay:            map[string]int{"2015-03-14": 2},
+		PerCountry:        map[string]int{"US": 2},
+		SitePerDay:        map[string]int{"2015-03-14": 2},
+		SitePerCountry:    map[string]int{"US": 2},
+		UnknownRefererErr: true,
+	}
+	if !reflect.DeepEqual(sqliteCounts, want) {
+		t.Errorf("sqlite: got %+v, want %+v", sqliteCounts, want)
+	}
+	if !reflect.DeepEqual(memoryCounts, want) {
+		t.Errorf("memory: got %+v, want %+v", memoryCounts, want)
+	}
+}
+
+func TestTaskFunctionNamesAreLowerCase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encore-store")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sqlite := openSqlite(filepath.Join(dir, "encore.db")).(*sqliteStore)
+	defer sqlite.Close()
+	if err := sqlite.Migrate(); err != nil {
+		t.Fatalf("error migrating sqlite store: %v", err)
+	}
+
+	for name, s := range map[string]Store{"memory": NewMemoryStore(), "sqlite": sqlite} {
+		id, err := s.CreateTaskFunction(TaskFunction{Name: " All_Tasks ", Weight: 1})
+		if err != nil {
+			t.Fatalf("%s: error creating task function: %v", name, err)
+		}
+		taskFunctions, err := s.TaskFunctions()
+		if err != nil {
+			t.Fatalf("%s: error listing task functions: %v", name, err)
+		}
+		if len(taskFunctions) != 1 || taskFunctions[0].Name != "all_tasks" {
+			t.Errorf("%s: task functions = %+v, want all_tasks", name, taskFunctions)
+		}
+
+		if err := s.UpdateTaskFunction(TaskFunction{Id: id, Name: "Other_Tasks", Weight: 1}); err != nil {
+			t.Fatalf("%s: error updating task function: %v", name, err)
+		}
+		taskFunctions, err = s.TaskFunctions()
+		if err != nil {
+			t.Fatalf("%s: error listing task functions: %v", name, err)
+		}
+		if len(taskFunctions) != 1 || taskFunctions[0].Name != "other_tasks" {
+			t.Errorf("%s: task functions = %+v, want other_tasks", name, taskFunctions)
+		}
+	}
+
+	if _, ok := lookupTaskFilter("ALL_TASKS"); !ok {
+		t.Errorf("task filter lookups should ignore case")
+	}
+}
+
+func TestStatsServeBeforeResultsAreComputed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encore-store")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sqlite := openSqlite(filepath.Join(dir, "encore.db")).(*sqliteStore)
+	defer sqlite.Close()
+	if err := sqlite.Migrate(); err != nil {
+		t.Fatalf("error migrating sqlite store: %v", err)
+	}
+
+	countRequests := make(chan CountResultsRequest)
+	go sqlite.CountResultsForReferrer(countRequests)
+	response := make(chan CountResultsResponse)
+	countRequests <- CountResultsRequest{Site: 7, Response: response}
+	if answer := <-response; answer.Err != sql.ErrNoRows {
+		t.Errorf("site count = %+v, want sql.ErrNoRows", answer)
+	}
+	close(countRequests)
+
+	dayRequests := make(chan ResultsPerDayRequest)
+	go sqlite.ResultsPerDayForReferrer(dayRequests)
+	dayResponse := make(chan ResultsPerDayResponse)
+	dayRequests <- ResultsPerDayRequest{Site: 7, Response: dayResponse}
+	if answer := <-dayResponse; answer.Err != nil || len(answer.Results) != 0 {
+		t.Errorf("site results per day = %+v, want none", answer)
+	}
+	close(dayRequests)
+
+	countryRequests := make(chan ResultsPerCountryRequest)
+	go sqlite.ResultsPerCountryForReferrer(countryRequests)
+	countryResponse := make(chan ResultsPerCountryResponse)
+	countryRequests <- ResultsPerCountryRequest{Site: 7, Response: countryResponse}
+	if answer := <-countryResponse; answer.Err != nil || len(answer.Results) != 0 {
+		t.Errorf("site results per country = %+v, want none", answer)
+	}
+	close(countryRequests)
+
+	// The empty tables don't get in the way of computing the real ones.
+	if err := sqlite.ComputeResultsTables(); err != nil {
+		t.Errorf("error computing results tables: %v", err)
+	}
+}
@@ -0,0 +1,476 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// A migration moves the schema from version-1 to version. Released
+// migrations are never edited; add a new one to change the schema.
+type migration struct {
+	version     int
+	description string
+	postgres    string
+	sqlite      string
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		postgres: `
+CREATE EXTENSION IF NOT EXISTS hstore;
+
+CREATE SCHEMA task_functions;
+
+CREATE TABLE tasks (
+	id serial primary key,
+	parameters hstore
+);
+CREATE TABLE task_functions (
+	id serial primary key,
+	priority integer,
+	max_duration_seconds integer,
+	max_measurements integer,
+	max_rate_per_second integer,
+	task_function information_schema.sql_identifier,
+	enabled boolean
+);
+CREATE TABLE scheduled_functions (
+	task_function integer references task_functions(id),
+	expiration_time timestamp,
+	measurements_remaining integer,
+	priority integer,
+	scheduled_time timestamp
+);
+CREATE TABLE scheduler_configuration (
+	concurrent_functions integer
+);
+CREATE TABLE queries (
+	id serial primary key,
+	"timestamp" timestamp,
+	client_ip text,
+	raw_request bytea,
+	task integer references tasks(id),
+	substrate text,
+	parameters_json text,
+	response_body bytea
+);
+CREATE TABLE parsed_queries (
+	query integer references queries(id),
+	"timestamp" timestamp,
+	measurement_id text,
+	client_ip text,
+	client_location text,
+	substrate text,
+	parameters hstore
+);
+CREATE TABLE results (
+	id serial primary key,
+	"timestamp" timestamp,
+	client_ip text,
+	raw_request bytea
+);
+CREATE TABLE parsed_results (
+	result integer references results(id),
+	"timestamp" timestamp,
+	measurement_id text,
+	outcome text,
+	message text,
+	origin text,
+	referer text,
+	client_ip text,
+	client_location text,
+	user_agent text
+);`,
+		sqlite: `
+CREATE TABLE tasks (
+	id integer primary key autoincrement,
+	parameters text
+);
+CREATE TABLE task_functions (
+	id integer primary key autoincrement,
+	priority integer,
+	max_duration_seconds integer,
+	max_measurements integer,
+	max_rate_per_second integer,
+	task_function text,
+	enabled boolean
+);
+CREATE TABLE scheduled_functions (
+	task_function integer references task_functions(id),
+	expiration_time integer,
+	measurements_remaining integer,
+	priority integer,
+	scheduled_time integer
+);
+CREATE TABLE scheduler_configuration (
+	concurrent_functions integer
+);
+CREATE TABLE queries (
+	id integer primary key autoincrement,
+	"timestamp" datetime,
+	client_ip text,
+	raw_request blob,
+	task integer references tasks(id),
+	substrate text,
+	parameters_json text,
+	response_body blob
+);
+CREATE TABLE parsed_queries (
+	query integer references queries(id),
+	"timestamp" datetime,
+	measurement_id text,
+	client_ip text,
+	client_location text,
+	substrate text,
+	parameters text
+);
+CREATE TABLE results (
+	id integer primary key autoincrement,
+	"timestamp" datetime,
+	client_ip text,
+	raw_request blob
+);
+CREATE TABLE parsed_results (
+	result integer references results(id),
+	"timestamp" datetime,
+	measurement_id text,
+	outcome text,
+	message text,
+	origin text,
+	referer text,
+	client_ip text,
+	client_location text,
+	user_agent text
+);`,
+	},
+	{
+		version:     2,
+		description: "give scheduled_functions a primary key",
+		postgres: `
+ALTER TABLE scheduled_functions ADD COLUMN id serial primary key;`,
+		sqlite: `
+CREATE TABLE scheduled_functions_new (
+	id integer primary key autoincrement,
+	task_function integer references task_functions(id),
+	expiration_time integer,
+	measurements_remaining integer,
+	priority integer,
+	scheduled_time integer
+);
+INSERT INTO scheduled_functions_new (task_function, expiration_time, measurements_remaining, priority, scheduled_time)
+	SELECT task_function, expiration_time, measurements_remaining, priority, scheduled_time FROM scheduled_functions;
+DROP TABLE scheduled_functions;
+ALTER TABLE scheduled_functions_new RENAME TO scheduled_functions;`,
+	},
+	{
+		version:     3,
+		description: "weight task functions' share of traffic",
+		postgres: `
+ALTER TABLE task_functions ADD COLUMN weight integer DEFAULT 1;`,
+		sqlite: `
+ALTER TABLE task_functions ADD COLUMN weight integer DEFAULT 1;`,
+	},
+	{
+		version:     4,
+		description: "target task functions by country",
+		postgres: `
+ALTER TABLE task_functions ADD COLUMN include_countries text;
+ALTER TABLE task_functions ADD COLUMN exclude_countries text;
+ALTER TABLE task_functions ADD COLUMN country_quotas text;
+CREATE TABLE scheduled_country_quotas (
+	scheduled_function integer references scheduled_functions(id) on delete cascade,
+	country text,
+	measurements_remaining integer,
+	primary key (scheduled_function, country)
+);`,
+		sqlite: `
+ALTER TABLE task_functions ADD COLUMN include_countries text;
+ALTER TABLE task_functions ADD COLUMN exclude_countries text;
+ALTER TABLE task_functions ADD COLUMN country_quotas text;
+CREATE TABLE scheduled_country_quotas (
+	scheduled_function integer references scheduled_functions(id) on delete cascade,
+	country text,
+	measurements_remaining integer,
+	primary key (scheduled_function, country)
+);`,
+	},
+	{
+		version:     5,
+		description: "record the template version of each query",
+		postgres: `
+ALTER TABLE queries ADD COLUMN template_hash text;
+ALTER TABLE queries ADD COLUMN git_revision text;
+ALTER TABLE parsed_queries ADD COLUMN template_hash text;
+ALTER TABLE parsed_queries ADD COLUMN git_revision text;`,
+		sqlite: `
+ALTER TABLE queries ADD COLUMN template_hash text;
+ALTER TABLE queries ADD COLUMN git_revision text;
+ALTER TABLE parsed_queries ADD COLUMN template_hash text;
+ALTER TABLE parsed_queries ADD COLUMN git_revision text;`,
+	},
+	{
+		// Results from before this migration have NULL authenticated and
+		// still count.
+		version:     6,
+		description: "record whether results have a signed measurement id",
+		postgres: `
+ALTER TABLE results ADD COLUMN authenticated boolean;`,
+		sqlite: `
+ALTER TABLE results ADD COLUMN authenticated boolean;`,
+	},
+	{
+		version:     7,
+		description: "record the network and city of clients",
+		postgres: `
+ALTER TABLE parsed_queries ADD COLUMN client_asn integer;
+ALTER TABLE parsed_queries ADD COLUMN client_organization text;
+ALTER TABLE parsed_queries ADD COLUMN client_city text;
+ALTER TABLE parsed_results ADD COLUMN client_asn integer;
+ALTER TABLE parsed_results ADD COLUMN client_organization text;
+ALTER TABLE parsed_results ADD COLUMN client_city text;`,
+		sqlite: `
+ALTER TABLE parsed_queries ADD COLUMN client_asn integer;
+ALTER TABLE parsed_queries ADD COLUMN client_organization text;
+ALTER TABLE parsed_queries ADD COLUMN client_city text;
+ALTER TABLE parsed_results ADD COLUMN client_asn integer;
+ALTER TABLE parsed_results ADD COLUMN client_organization text;
+ALTER TABLE parsed_results ADD COLUMN client_city text;`,
+	},
+	{
+		version:     8,
+		description: "count opt-outs per referer",
+		postgres: `
+CREATE TABLE opt_outs (
+	"timestamp" timestamp,
+	referer text,
+	reason text
+);
+CREATE INDEX opt_outs_referer ON opt_outs (referer);`,
+		sqlite: `
+CREATE TABLE opt_outs (
+	"timestamp" timestamp,
+	referer text,
+	reason text
+);
+CREATE INDEX opt_outs_referer ON opt_outs (referer);`,
+	},
+	{
+		version:     9,
+		description: "register sites and attribute queries to them",
+		postgres: `
+CREATE TABLE sites (
+	id serial primary key,
+	site_key text unique,
+	name text,
+	contact_email text,
+	allowed_task_types text,
+	show_stats boolean,
+	enabled boolean
+);
+ALTER TABLE queries ADD COLUMN site integer references sites(id);
+ALTER TABLE parsed_queries ADD COLUMN site integer;
+ALTER TABLE opt_outs ADD COLUMN site integer;
+CREATE INDEX parsed_queries_measurement_id ON parsed_queries (measurement_id);
+CREATE INDEX opt_outs_site ON opt_outs (site);`,
+		sqlite: `
+CREATE TABLE sites (
+	id integer primary key autoincrement,
+	site_key text unique,
+	name text,
+	contact_email text,
+	allowed_task_types text,
+	show_stats boolean,
+	enabled boolean
+);
+ALTER TABLE queries ADD COLUMN site integer references sites(id);
+ALTER TABLE parsed_queries ADD COLUMN site integer;
+ALTER TABLE opt_outs ADD COLUMN site integer;
+CREATE INDEX parsed_queries_measurement_id ON parsed_queries (measurement_id);
+CREATE INDEX opt_outs_site ON opt_outs (site);`,
+	},
+	{
+		version:     10,
+		description: "choose the client runtime per site",
+		postgres: `
+ALTER TABLE sites ADD COLUMN runtime text;`,
+		sqlite: `
+ALTER TABLE sites ADD COLUMN runtime text;`,
+	},
+	{
+		version:     11,
+		description: "record resource timings of fetch tasks",
+		postgres: `
+ALTER TABLE parsed_results ADD COLUMN timing_dns integer;
+ALTER TABLE parsed_results ADD COLUMN timing_connect integer;
+ALTER TABLE parsed_results ADD COLUMN timing_tls integer;
+ALTER TABLE parsed_results ADD COLUMN timing_request integer;
+ALTER TABLE parsed_results ADD COLUMN timing_response integer;
+ALTER TABLE parsed_results ADD COLUMN timing_duration integer;`,
+		sqlite: `
+ALTER TABLE parsed_results ADD COLUMN timing_dns integer;
+ALTER TABLE parsed_results ADD COLUMN timing_connect integer;
+ALTER TABLE parsed_results ADD COLUMN timing_tls integer;
+ALTER TABLE parsed_results ADD COLUMN timing_request integer;
+ALTER TABLE parsed_results ADD COLUMN timing_response integer;
+ALTER TABLE parsed_results ADD COLUMN timing_duration integer;`,
+	},
+	{
+		version:     12,
+		description: "record the sub-targets of multi-target tasks",
+		postgres: `
+ALTER TABLE parsed_results ADD COLUMN sub_target text;`,
+		sqlite: `
+ALTER TABLE parsed_results ADD COLUMN sub_target text;`,
+	},
+	{
+		// Task function names used to be case-insensitive, because they
+		// were spliced into queries unquoted. Now that they are quoted,
+		// names with capitals would stop matching their functions.
+		version:     13,
+		description: "fold task function names to lower case",
+		postgres: `
+UPDATE task_functions SET task_function = lower(task_function);`,
+		sqlite: `
+UPDATE task_functions SET task_function = lower(task_function);`,
+	},
+	{
+		// Stats servers prepare queries on the results tables when they
+		// start, but only ComputeResultsTables used to create them.
+		version:     14,
+		description: "create empty results tables for stats servers",
+		postgres: `
+CREATE TABLE IF NOT EXISTS results_per_referer (referer text, results bigint);
+CREATE TABLE IF NOT EXISTS results_per_day (referer text, day date, results bigint);
+CREATE TABLE IF NOT EXISTS results_per_country (referer text, country text, results bigint);
+CREATE TABLE IF NOT EXISTS site_results (site integer, results bigint);
+CREATE TABLE IF NOT EXISTS site_results_per_day (site integer, day date, results bigint);
+CREATE TABLE IF NOT EXISTS site_results_per_country (site integer, country text, results bigint);`,
+		sqlite: `
+CREATE TABLE IF NOT EXISTS results_per_referer (referer text, results integer);
+CREATE TABLE IF NOT EXISTS results_per_day (referer text, day text, results integer);
+CREATE TABLE IF NOT EXISTS results_per_country (referer text, country text, results integer);
+CREATE TABLE IF NOT EXISTS site_results (site integer, results integer);
+CREATE TABLE IF NOT EXISTS site_results_per_day (site integer, day text, results integer);
+CREATE TABLE IF NOT EXISTS site_results_per_country (site integer, country text, results integer);`,
+	},
+}
+
+// LatestSchemaVersion is the schema version this code expects.
+var LatestSchemaVersion = migrations[len(migrations)-1].version
+
+func (m migration) statements(dialect string) string {
+	if dialect == sqliteDialect {
+		return m.sqlite
+	}
+	return m.postgres
+}
+
+func tableExists(db *sql.DB, dialect, table string) (bool, error) {
+	query := "SELECT count(1) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1"
+	if dialect == sqliteDialect {
+		query = "SELECT count(1) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	}
+	var count int
+	if err := db.QueryRow(query, table).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// databaseSchemaVersion returns 0 for an empty database. Databases created
+// before schema_version existed have a tasks table; those are at version 1.
+func databaseSchemaVersion(db *sql.DB, dialect string) (version int, versioned bool, err error) {
+	versioned, err = tableExists(db, dialect, "schema_version")
+	if err != nil {
+		return 0, false, err
+	}
+	if !versioned {
+		hasTasks, err := tableExists(db, dialect, "tasks")
+		if err != nil {
+			return 0, false, err
+		}
+		if hasTasks {
+			return 1, false, nil
+		}
+		return 0, false, nil
+	}
+
+	var maxVersion sql.NullInt64
+	if err := db.QueryRow("SELECT max(version) FROM schema_version").Scan(&maxVersion); err != nil {
+		return 0, true, err
+	}
+	return int(maxVersion.Int64), true, nil
+}
+
+// migrateDatabase applies each pending migration in its own transaction.
+func migrateDatabase(db *sql.DB, dialect string) error {
+	current, versioned, err := databaseSchemaVersion(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	insertVersion := rebind(dialect, "INSERT INTO schema_version (version, applied_time) VALUES ($1, $2)")
+
+	if !versioned {
+		if _, err := db.Exec("CREATE TABLE schema_version (version integer primary key, applied_time timestamp)"); err != nil {
+			return err
+		}
+		if current > 0 {
+			log.Printf("recording existing schema as version %d", current)
+			if _, err := db.Exec(insertVersion, current, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		log.Printf("applying migration %d: %s", m.version, m.description)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.statements(dialect)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+		if _, err := tx.Exec(insertVersion, m.version, time.Now()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+func checkSchemaVersion(s Store) error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+	if version < LatestSchemaVersion {
+		return fmt.Errorf("database schema is at version %d but this code requires version %d; run with -migrate", version, LatestSchemaVersion)
+	}
+	return nil
+}
+
+func migrateIfAsked(s Store) {
+	if !migrateSchema {
+		return
+	}
+
+	if err := s.Migrate(); err != nil {
+		log.Fatalf("error migrating schema: %v", err)
+	}
+	log.Printf("schema is at version %d", LatestSchemaVersion)
+	os.Exit(0)
+}
@@ -7,7 +7,7 @@ import (
 	"log"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/lib/pq/hstore"
 	"github.com/rcrowley/go-metrics"
 )
@@ -37,6 +37,15 @@ func (store *postgresStore) Close() {
 	store.db.Close()
 }
 
+func (store *postgresStore) SchemaVersion() (int, error) {
+	version, _, err := databaseSchemaVersion(store.db, postgresDialect)
+	return version, err
+}
+
+func (store *postgresStore) Migrate() error {
+	return migrateDatabase(store.db, postgresDialect)
+}
+
 func insertTaskFunctions(tx *sql.Tx) error {
 	var minTaskFunction, minPriority int
 	row := tx.QueryRow("SELECT task_function, priority FROM scheduled_functions ORDER BY scheduled_time DESC, priority DESC, task_function DESC LIMIT 1")
@@ -51,11 +60,14 @@ func insertTaskFunctions(tx *sql.Tx) error {
 
 	log.Printf("min task function: %v, min priority: %v", minTaskFunction, minPriority)
 
-	if _, err := tx.Exec("DELETE FROM scheduled_functions WHERE expiration_time < now() OR measurements_remaining <= 0"); err != nil {
+	if _, err := tx.Exec("DELETE FROM scheduled_functions WHERE expiration_time < now() OR measurements_remaining <= 0 OR task_function IN (SELECT id FROM task_functions WHERE NOT coalesce(enabled, false))"); err != nil {
 		log.Printf("error deleting expired task functions: %v", err)
 		deleteExpiredFunctionsErrorCounter.Inc(1)
 		return err
 	}
+	if err := deleteExhaustedSchedules(tx, postgresDialect); err != nil {
+		return err
+	}
 
 	var toSchedule int
 	row = tx.QueryRow("SELECT concurrent_functions - scheduled FROM (SELECT count(1) scheduled FROM scheduled_functions) AS c, scheduler_configuration")
@@ -91,6 +103,9 @@ func insertTaskFunctions(tx *sql.Tx) error {
 		return err
 	}
 	toSchedule -= int(rowsAffected)
+	if err := insertCountryQuotas(tx, postgresDialect); err != nil {
+		return err
+	}
 	if toSchedule > 0 {
 		log.Printf("unable to fill schedule")
 		unfilledScheduleCounter.Inc(1)
@@ -98,8 +113,14 @@ func insertTaskFunctions(tx *sql.Tx) error {
 	return nil
 }
 
+// ScheduleTaskFunctions only schedules while this instance holds the scheduler
+// lock, so that instances sharing a database don't race to insert schedules.
 func (store *postgresStore) ScheduleTaskFunctions() {
+	election := newAdvisoryLockElection(store.db)
 	schedule := func() {
+		if !election.lead() {
+			return
+		}
 		tx, err := store.db.Begin()
 		if err != nil {
 			log.Printf("error starting transaction: %v", err)
@@ -121,62 +142,87 @@ func (store *postgresStore) ScheduleTaskFunctions() {
 	}
 }
 
+func (store *postgresStore) TaskFunctions() ([]TaskFunction, error) {
+	return selectTaskFunctions(store.db)
+}
+
+func (store *postgresStore) CreateTaskFunction(taskFunction TaskFunction) (int, error) {
+	return insertTaskFunction(store.db, postgresDialect, taskFunction)
+}
+
+func (store *postgresStore) UpdateTaskFunction(taskFunction TaskFunction) error {
+	return updateTaskFunction(store.db, postgresDialect, taskFunction)
+}
+
+func (store *postgresStore) ConcurrentFunctions() (int, error) {
+	return selectConcurrentFunctions(store.db)
+}
+
+func (store *postgresStore) SetConcurrentFunctions(concurrentFunctions int) error {
+	return updateConcurrentFunctions(store.db, postgresDialect, concurrentFunctions)
+}
+
+func (store *postgresStore) Schedules() ([]Schedule, error) {
+	return selectSchedules(store.db)
+}
+
+func (store *postgresStore) Sites() ([]Site, error) {
+	return selectSites(store.db)
+}
+
+func (store *postgresStore) CreateSite(site Site) (int, error) {
+	return insertSite(store.db, postgresDialect, site)
+}
+
+func (store *postgresStore) UpdateSite(site Site) error {
+	return updateSite(store.db, postgresDialect, site)
+}
+
+func (store *postgresStore) selectTask(taskFunction string, hints map[string]string) *Task {
+	queryString := fmt.Sprintf("SELECT id, parameters FROM task_functions.%s($1) ORDER BY random() LIMIT 1", pq.QuoteIdentifier(taskFunction))
+	hintsHstore := hstore.Hstore{
+		Map: make(map[string]sql.NullString),
+	}
+	for k, v := range hints {
+		hintsHstore.Map[k] = sql.NullString{
+			String: v,
+			Valid:  true,
+		}
+	}
+	row := store.db.QueryRow(queryString, hintsHstore)
+	var id int
+	var parameters hstore.Hstore
+	if err := row.Scan(&id, &parameters); err != nil {
+		log.Printf("error scanning task parameters: %v", err)
+		return nil
+	}
+	return &Task{
+		Id:         id,
+		Parameters: parameters.Map,
+	}
+}
+
 func (store *postgresStore) Tasks(taskRequests <-chan *TaskRequest) {
 	updateTicker := time.Tick(*schedulingInterval)
+	flushTicker := time.Tick(*servedFlushInterval)
 
-	selectStmt, err := store.db.Prepare("SELECT task_functions.task_function FROM scheduled_functions JOIN task_functions ON scheduled_functions.task_function = id ORDER BY id")
+	functions, err := selectScheduledTaskFunctions(store.db)
 	if err != nil {
-		log.Fatalf("error preparing schedules select statement: %v", err)
+		log.Fatalf("%v", err)
 	}
-
-	refreshTaskFunctions := func() []string {
-		rows, err := selectStmt.Query()
-		if err != nil {
-			log.Fatalf("error selecting schedules: %v", err)
-		}
-		var taskFunctions []string
-		for rows.Next() {
-			var taskFunction string
-			if err := rows.Scan(&taskFunction); err != nil {
-				log.Fatalf("error scanning task function: %v", err)
-			}
-			taskFunctions = append(taskFunctions, taskFunction)
-		}
-		return taskFunctions
+	selector := newTaskFunctionSelector(functions, newSchedulingRand())
+	writeCounts := func(served servedCounts) error {
+		return writeServed(store.db, postgresDialect, served)
+	}
+	readSchedules := func() ([]scheduledTaskFunction, error) {
+		return selectScheduledTaskFunctions(store.db)
 	}
-
-	currentTaskFunctions := refreshTaskFunctions()
-	functionIdx := 0
-	var currentTaskFunction string
 	for {
-		if len(currentTaskFunctions) > 0 {
-			functionIdx = (functionIdx + 1) % len(currentTaskFunctions)
-			currentTaskFunction = currentTaskFunctions[functionIdx]
-		}
-
 		select {
 		case taskRequest := <-taskRequests:
-			queryString := fmt.Sprintf("SELECT id, parameters FROM task_functions.%[1]s($1) ORDER BY random() LIMIT 1", currentTaskFunction)
-			hints := hstore.Hstore{
-				Map: make(map[string]sql.NullString),
-			}
-			for k, v := range taskRequest.Hints {
-				hints.Map[k] = sql.NullString{
-					String: v,
-					Valid:  true,
-				}
-			}
-			row := store.db.QueryRow(queryString, hints)
-			var task *Task
-			var id int
-			var parameters hstore.Hstore
-			if err := row.Scan(&id, &parameters); err != nil {
-				log.Printf("error scanning task parameters: %v", err)
-			} else {
-				task = new(Task)
-				task.Id = id
-				task.Parameters = parameters.Map
-			}
+			task := selector.serve(time.Now(), taskRequest.Hints, func(taskFunction string) *Task {
+				return store.selectTask(taskFunction, taskRequest.Hints)
+			})
 			select {
 			case taskRequest.Response <- task:
 			case <-time.After(time.Second):
@@ -184,9 +230,11 @@ func (store *postgresStore) Tasks(taskRequests <-chan *TaskRequest) {
 			}
 			close(taskRequest.Response)
 
+		case <-flushTicker:
+			selector.flush(writeCounts, readSchedules)
+
 		case <-updateTicker:
-			currentTaskFunctions = refreshTaskFunctions()
-			functionIdx = 0
+			selector.flush(writeCounts, readSchedules)
 		}
 	}
 }
@@ -208,15 +256,62 @@ func (store *postgresStore) WriteTasks(tasks <-chan *Task) {
 	}
 }
 
+// AllTasks returns every row of tasks, in id order.
+func (store *postgresStore) AllTasks() <-chan *Task {
+	tasks := make(chan *Task)
+	go func() {
+		defer close(tasks)
+		rows, err := store.db.Query("SELECT id, parameters FROM tasks ORDER BY id")
+		if err != nil {
+			log.Fatalf("error selecting tasks: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var task Task
+			var parameters hstore.Hstore
+			if err := rows.Scan(&task.Id, &parameters); err != nil {
+				log.Fatalf("error scanning task: %v", err)
+			}
+			task.Parameters = parameters.Map
+			tasks <- &task
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatalf("error selecting tasks: %v", err)
+		}
+	}()
+	return tasks
+}
+
+// InsertTasks inserts tasks in a single transaction and returns their ids.
+func (store *postgresStore) InsertTasks(tasks []*Task) ([]int, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, task := range tasks {
+		var id int
+		if err := tx.QueryRow("INSERT INTO tasks (parameters) VALUES ($1) RETURNING id", hstore.Hstore{task.Parameters}).Scan(&id); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func (store *postgresStore) WriteQueries(queries <-chan *Query) {
-	queriesStmt, err := store.db.Prepare("INSERT INTO queries (timestamp, client_ip, task, raw_request, substrate, parameters_json, response_body) VALUES ($1, $2, $3, $4, $5, $6, $7)")
+	queriesStmt, err := store.db.Prepare("INSERT INTO queries (timestamp, client_ip, task, raw_request, substrate, parameters_json, response_body, template_hash, git_revision, site) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)")
 	if err != nil {
 		log.Fatalf("error preparing queries insert statement: %v", err)
 	}
 	defer queriesStmt.Close()
 
 	for query := range queries {
-		if _, err := queriesStmt.Exec(query.Timestamp, query.RemoteAddr, query.Task, query.RawRequest, query.Substrate, query.ParametersJson, query.ResponseBody); err != nil {
+		if _, err := queriesStmt.Exec(query.Timestamp, query.RemoteAddr, nullIfZero(query.Task), query.RawRequest, query.Substrate, query.ParametersJson, query.ResponseBody, query.TemplateHash, query.GitRevision, nullIfZero(query.Site)); err != nil {
 			log.Printf("error inserting query: %v", err)
 			continue
 		}
@@ -232,7 +327,7 @@ func (store *postgresStore) Queries() <-chan *Query {
 	go func() {
 		defer close(queries)
 
-		rows, err := store.db.Query("SELECT id, timestamp, client_ip, task, raw_request, substrate, parameters_json FROM queries")
+		rows, err := store.db.Query("SELECT id, timestamp, client_ip, coalesce(task, 0), raw_request, substrate, parameters_json, coalesce(template_hash, ''), coalesce(git_revision, ''), coalesce(site, 0) FROM queries")
 		if err != nil {
 			log.Fatalf("error selecting queries: %v", err)
 		}
@@ -240,7 +335,7 @@ func (store *postgresStore) Queries() <-chan *Query {
 
 		for rows.Next() {
 			var query Query
-			if err := rows.Scan(&query.Id, &query.Timestamp, &query.RemoteAddr, &query.Task, &query.RawRequest, &query.Substrate, &query.ParametersJson); err != nil {
+			if err := rows.Scan(&query.Id, &query.Timestamp, &query.RemoteAddr, &query.Task, &query.RawRequest, &query.Substrate, &query.ParametersJson, &query.TemplateHash, &query.GitRevision, &query.Site); err != nil {
 				log.Printf("error reading query: %v", err)
 			}
 			queries <- &query
@@ -257,7 +352,7 @@ func (store *postgresStore) UnparsedQueries() <-chan *Query {
 	go func() {
 		defer close(queries)
 
-		rows, err := store.db.Query("SELECT id, timestamp, client_ip, task, raw_request, substrate, parameters_json FROM queries WHERE NOT EXISTS (SELECT NULL FROM parsed_queries WHERE query = id)")
+		rows, err := store.db.Query("SELECT id, timestamp, client_ip, coalesce(task, 0), raw_request, substrate, parameters_json, coalesce(template_hash, ''), coalesce(git_revision, ''), coalesce(site, 0) FROM queries WHERE NOT EXISTS (SELECT NULL FROM parsed_queries WHERE query = id)")
 		if err != nil {
 			log.Fatalf("error selecting queries: %v", err)
 		}
@@ -265,7 +360,7 @@ func (store *postgresStore) UnparsedQueries() <-chan *Query {
 
 		for rows.Next() {
 			var query Query
-			if err := rows.Scan(&query.Id, &query.Timestamp, &query.RemoteAddr, &query.Task, &query.RawRequest, &query.Substrate, &query.ParametersJson); err != nil {
+			if err := rows.Scan(&query.Id, &query.Timestamp, &query.RemoteAddr, &query.Task, &query.RawRequest, &query.Substrate, &query.ParametersJson, &query.TemplateHash, &query.GitRevision, &query.Site); err != nil {
 				log.Printf("error reading query: %v", err)
 			}
 			queries <- &query
@@ -278,14 +373,14 @@ func (store *postgresStore) UnparsedQueries() <-chan *Query {
 }
 
 func (store *postgresStore) WriteParsedQueries(parsedQueries <-chan *ParsedQuery) {
-	insertIntoQueries, err := store.db.Prepare(`INSERT INTO parsed_queries (query, measurement_id, timestamp, client_ip, client_location, substrate, parameters) VALUES ($1, $2, $3, $4, $5, $6, $7)`)
+	insertIntoQueries, err := store.db.Prepare(`INSERT INTO parsed_queries (query, measurement_id, timestamp, client_ip, client_location, client_asn, client_organization, client_city, substrate, parameters, template_hash, git_revision, site) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`)
 	if err != nil {
 		log.Fatalf("error preparing parsed_queries insert statement: %v", err)
 	}
 	defer insertIntoQueries.Close()
 
 	for parsedQuery := range parsedQueries {
-		if _, err := insertIntoQueries.Exec(parsedQuery.Query, parsedQuery.MeasurementId, parsedQuery.Timestamp, parsedQuery.ClientIp.String(), parsedQuery.ClientLocation, parsedQuery.Substrate, hstore.Hstore{parsedQuery.Parameters}); err != nil {
+		if _, err := insertIntoQueries.Exec(parsedQuery.Query, parsedQuery.MeasurementId, parsedQuery.Timestamp, parsedQuery.ClientIp.String(), parsedQuery.ClientLocation, nullIfZero(parsedQuery.ClientAsn), parsedQuery.ClientOrganization, parsedQuery.ClientCity, parsedQuery.Substrate, hstore.Hstore{parsedQuery.Parameters}, parsedQuery.TemplateHash, parsedQuery.GitRevision, nullIfZero(parsedQuery.Site)); err != nil {
 			log.Printf("error inserting parsed query: %v", err)
 		}
 	}
@@ -296,14 +391,14 @@ func (store *postgresStore) WriteParsedQueries(parsedQueries <-chan *ParsedQuery
 }
 
 func (store *postgresStore) WriteResults(results <-chan *Result) {
-	resultsStmt, err := store.db.Prepare("INSERT INTO results (timestamp, client_ip, raw_request) VALUES ($1, $2, $3)")
+	resultsStmt, err := store.db.Prepare("INSERT INTO results (timestamp, client_ip, raw_request, authenticated) VALUES ($1, $2, $3, $4)")
 	if err != nil {
 		log.Fatalf("error preparing results insert statement: %v", err)
 	}
 	defer resultsStmt.Close()
 
 	for result := range results {
-		if _, err := resultsStmt.Exec(result.Timestamp, result.RemoteAddr, result.RawRequest); err != nil {
+		if _, err := resultsStmt.Exec(result.Timestamp, result.RemoteAddr, result.RawRequest, result.Authenticated); err != nil {
 			log.Printf("error inserting result: %v", err)
 			continue
 		}
@@ -319,13 +414,13 @@ func (store *postgresStore) Results() <-chan *Result {
 	go func() {
 		defer close(results)
 
-		rows, err := store.db.Query("SELECT id, timestamp, client_ip, raw_request FROM results")
+		rows, err := store.db.Query("SELECT id, timestamp, client_ip, raw_request, authenticated FROM results")
 		if err != nil {
 			log.Fatalf("error selecting results: %v", err)
 		}
 		for rows.Next() {
 			var result Result
-			if err := rows.Scan(&result.Id, &result.Timestamp, &result.RemoteAddr, &result.RawRequest); err != nil {
+			if err := rows.Scan(&result.Id, &result.Timestamp, &result.RemoteAddr, &result.RawRequest, &result.Authenticated); err != nil {
 				log.Printf("error scanning result: %v", err)
 			}
 			results <- &result
@@ -342,13 +437,13 @@ func (store *postgresStore) UnparsedResults() <-chan *Result {
 	go func() {
 		defer close(results)
 
-		rows, err := store.db.Query("SELECT id, timestamp, client_ip, raw_request FROM results WHERE NOT EXISTS (SELECT NULL FROM parsed_results WHERE result = id)")
+		rows, err := store.db.Query("SELECT id, timestamp, client_ip, raw_request, authenticated FROM results WHERE coalesce(authenticated, true) AND NOT EXISTS (SELECT NULL FROM parsed_results WHERE result = id)")
 		if err != nil {
 			log.Fatalf("error selecting results: %v", err)
 		}
 		for rows.Next() {
 			var result Result
-			if err := rows.Scan(&result.Id, &result.Timestamp, &result.RemoteAddr, &result.RawRequest); err != nil {
+			if err := rows.Scan(&result.Id, &result.Timestamp, &result.RemoteAddr, &result.RawRequest, &result.Authenticated); err != nil {
 				log.Printf("error scanning result: %v", err)
 			}
 			results <- &result
@@ -361,14 +456,14 @@ func (store *postgresStore) UnparsedResults() <-chan *Result {
 }
 
 func (store *postgresStore) WriteParsedResults(parsedResults <-chan *ParsedResult) {
-	insertIntoResults, err := store.db.Prepare("INSERT INTO parsed_results (result, measurement_id, timestamp, outcome, message, origin, referer, client_ip, client_location, user_agent) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)")
+	insertIntoResults, err := store.db.Prepare("INSERT INTO parsed_results (result, measurement_id, timestamp, outcome, message, origin, referer, client_ip, client_location, client_asn, client_organization, client_city, user_agent, timing_dns, timing_connect, timing_tls, timing_request, timing_response, timing_duration, sub_target) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)")
 	if err != nil {
 		log.Fatalf("error preparing parsed_results insertion statement: %v", err)
 	}
 	defer insertIntoResults.Close()
 
 	for parsedResult := range parsedResults {
-		if _, err := insertIntoResults.Exec(parsedResult.Result, parsedResult.MeasurementId, parsedResult.Timestamp, parsedResult.Outcome, parsedResult.Message, parsedResult.Origin, parsedResult.Referer, parsedResult.ClientIp.String(), parsedResult.ClientLocation, parsedResult.UserAgent); err != nil {
+		if _, err := insertIntoResults.Exec(parsedResult.Result, parsedResult.MeasurementId, parsedResult.Timestamp, parsedResult.Outcome, parsedResult.Message, parsedResult.Origin, parsedResult.Referer, parsedResult.ClientIp.String(), parsedResult.ClientLocation, nullIfZero(parsedResult.ClientAsn), parsedResult.ClientOrganization, parsedResult.ClientCity, parsedResult.UserAgent, parsedResult.TimingDns, parsedResult.TimingConnect, parsedResult.TimingTls, parsedResult.TimingRequest, parsedResult.TimingResponse, parsedResult.TimingDuration, parsedResult.SubTarget); err != nil {
 			log.Printf("error inserting parsed result: %v", err)
 		}
 	}
@@ -378,6 +473,25 @@ func (store *postgresStore) WriteParsedResults(parsedResults <-chan *ParsedResul
 	}
 }
 
+func (store *postgresStore) WriteOptOuts(optOuts <-chan *OptOut) {
+	optOutsStmt, err := store.db.Prepare("INSERT INTO opt_outs (timestamp, referer, reason, site) VALUES ($1, $2, $3, $4)")
+	if err != nil {
+		log.Fatalf("error preparing opt-outs insert statement: %v", err)
+	}
+	defer optOutsStmt.Close()
+
+	for optOut := range optOuts {
+		if _, err := optOutsStmt.Exec(optOut.Timestamp, optOut.Referer, optOut.Reason, nullIfZero(optOut.Site)); err != nil {
+			log.Printf("error inserting opt-out: %v", err)
+			continue
+		}
+	}
+
+	if err := optOutsStmt.Close(); err != nil {
+		log.Printf("error while closing opt-outs insert statement: %v", err)
+	}
+}
+
 func (store *postgresStore) ComputeResultsTables() error {
 	tx, err := store.db.Begin()
 	if err != nil {
@@ -430,6 +544,43 @@ func (store *postgresStore) ComputeResultsTables() error {
 		return err
 	}
 
+	return store.computeSiteResultsTables()
+}
+
+// computeSiteResultsTables attributes results to sites through the query that
+// gave out their measurement id.
+func (store *postgresStore) computeSiteResultsTables() error {
+	for _, statements := range [][]string{
+		{
+			"DROP TABLE IF EXISTS site_results",
+			"SELECT parsed_queries.site, count(distinct parsed_results.measurement_id) results INTO site_results FROM parsed_results JOIN parsed_queries ON parsed_queries.measurement_id = parsed_results.measurement_id WHERE parsed_results.outcome = 'init' AND parsed_queries.site IS NOT NULL GROUP BY parsed_queries.site",
+			"CREATE INDEX ON site_results (site)",
+		},
+		{
+			"DROP TABLE IF EXISTS site_results_per_day",
+			`SELECT parsed_queries.site, parsed_results."timestamp"::date AS day, count(distinct parsed_results.measurement_id) results INTO site_results_per_day FROM parsed_results JOIN parsed_queries ON parsed_queries.measurement_id = parsed_results.measurement_id WHERE parsed_results.outcome = 'init' AND parsed_queries.site IS NOT NULL GROUP BY parsed_queries.site, parsed_results."timestamp"::date`,
+			"CREATE INDEX ON site_results_per_day (site)",
+		},
+		{
+			"DROP TABLE IF EXISTS site_results_per_country",
+			"SELECT parsed_queries.site, parsed_results.client_location country, count(distinct parsed_results.measurement_id) results INTO site_results_per_country FROM parsed_results JOIN parsed_queries ON parsed_queries.measurement_id = parsed_results.measurement_id WHERE parsed_results.outcome = 'init' AND parsed_queries.site IS NOT NULL GROUP BY parsed_queries.site, parsed_results.client_location",
+			"CREATE INDEX ON site_results_per_country (site)",
+		},
+	} {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -438,12 +589,17 @@ func (store *postgresStore) CountResultsForReferrer(requests <-chan CountResults
 	if err != nil {
 		log.Fatalf("error preparing result count statement: %v", err)
 	}
+	siteQuery, err := store.db.Prepare("SELECT results FROM site_results WHERE site = $1")
+	if err != nil {
+		log.Fatalf("error preparing site result count statement: %v", err)
+	}
 
 	for request := range requests {
-		row := query.QueryRow(request.Referer)
+		statement, key := statsStatement(query, siteQuery, request.Referer, request.Site)
+		row := statement.QueryRow(key)
 		var count int
 		if err := row.Scan(&count); err != nil {
-			log.Printf("error scanning result count %s: %v", request.Referer, err)
+			log.Printf("error scanning result count %v: %v", key, err)
 			request.Response <- CountResultsResponse{
 				Err: err,
 			}
@@ -458,6 +614,44 @@ func (store *postgresStore) CountResultsForReferrer(requests <-chan CountResults
 	if err := query.Close(); err != nil {
 		log.Printf("error while closing results query: %v", err)
 	}
+	if err := siteQuery.Close(); err != nil {
+		log.Printf("error while closing site results query: %v", err)
+	}
+}
+
+func (store *postgresStore) CountOptOutsForReferrer(requests <-chan CountResultsRequest) {
+	query, err := store.db.Prepare("SELECT count(1) FROM opt_outs WHERE referer = $1")
+	if err != nil {
+		log.Fatalf("error preparing opt-out count statement: %v", err)
+	}
+	siteQuery, err := store.db.Prepare("SELECT count(1) FROM opt_outs WHERE site = $1")
+	if err != nil {
+		log.Fatalf("error preparing site opt-out count statement: %v", err)
+	}
+
+	for request := range requests {
+		statement, key := statsStatement(query, siteQuery, request.Referer, request.Site)
+		row := statement.QueryRow(key)
+		var count int
+		if err := row.Scan(&count); err != nil {
+			log.Printf("error scanning opt-out count %v: %v", key, err)
+			request.Response <- CountResultsResponse{
+				Err: err,
+			}
+			continue
+		}
+		request.Response <- CountResultsResponse{
+			Count: count,
+			Err:   nil,
+		}
+	}
+
+	if err := query.Close(); err != nil {
+		log.Printf("error while closing opt-outs query: %v", err)
+	}
+	if err := siteQuery.Close(); err != nil {
+		log.Printf("error while closing site opt-outs query: %v", err)
+	}
 }
 
 func (store *postgresStore) ResultsPerDayForReferrer(requests <-chan ResultsPerDayRequest) {
@@ -465,9 +659,14 @@ func (store *postgresStore) ResultsPerDayForReferrer(requests <-chan ResultsPerD
 	if err != nil {
 		log.Fatalf("error preparing result count statement: %v", err)
 	}
+	siteQuery, err := store.db.Prepare("SELECT day, results FROM site_results_per_day WHERE site = $1 ORDER BY day")
+	if err != nil {
+		log.Fatalf("error preparing site result count statement: %v", err)
+	}
 
 	for request := range requests {
-		rows, err := query.Query(request.Referer)
+		statement, key := statsStatement(query, siteQuery, request.Referer, request.Site)
+		rows, err := statement.Query(key)
 		if err != nil {
 			request.Response <- ResultsPerDayResponse{
 				Err: err,
@@ -506,6 +705,9 @@ func (store *postgresStore) ResultsPerDayForReferrer(requests <-chan ResultsPerD
 	if err := query.Close(); err != nil {
 		log.Printf("error while closing results per day query: %v", err)
 	}
+	if err := siteQuery.Close(); err != nil {
+		log.Printf("error while closing site results per day query: %v", err)
+	}
 }
 
 func (store *postgresStore) ResultsPerCountryForReferrer(requests <-chan ResultsPerCountryRequest) {
@@ -513,9 +715,14 @@ func (store *postgresStore) ResultsPerCountryForReferrer(requests <-chan Results
 	if err != nil {
 		log.Fatalf("error preparing result count statement: %v", err)
 	}
+	siteQuery, err := store.db.Prepare("SELECT country, results FROM site_results_per_country WHERE site = $1 ORDER BY results DESC")
+	if err != nil {
+		log.Fatalf("error preparing site result count statement: %v", err)
+	}
 
 	for request := range requests {
-		rows, err := query.Query(request.Referer)
+		statement, key := statsStatement(query, siteQuery, request.Referer, request.Site)
+		rows, err := statement.Query(key)
 		if err != nil {
 			request.Response <- ResultsPerCountryResponse{
 				Err: err,
@@ -552,4 +759,7 @@ func (store *postgresStore) ResultsPerCountryForReferrer(requests <-chan Results
 	if err := query.Close(); err != nil {
 		log.Printf("error while closing results per country query: %v", err)
 	}
+	if err := siteQuery.Close(); err != nil {
+		log.Printf("error while closing site results per country query: %v", err)
+	}
 }
@@ -0,0 +1,411 @@
+package store
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var servedFlushInterval = flag.Duration("served_flush_interval", 10*time.Second, "write counts of served tasks to scheduled_functions and reload budgets this often. Each server spends budgets locally between flushes, so N servers may together overshoot measurements_remaining and country quotas by up to N-1 times what one server serves in this interval.")
+var taskFunctionSeed = flag.Int64("task_function_seed", 0, "seed for choosing among scheduled task functions. 0 seeds from the clock.")
+
+var scheduleExhaustedCounter = metrics.GetOrRegisterCounter("ScheduleExhausted", nil)
+var flushServedErrorCounter = metrics.GetOrRegisterCounter("FlushServedError", nil)
+var taskFunctionThrottledCounter = metrics.GetOrRegisterCounter("TaskFunctionThrottled", nil)
+var allTaskFunctionsThrottledCounter = metrics.GetOrRegisterCounter("AllTaskFunctionsThrottled", nil)
+var selectSchedulesErrorCounter = metrics.GetOrRegisterCounter("SelectSchedulesError", nil)
+var taskFunctionEmptyCounter = metrics.GetOrRegisterCounter("TaskFunctionGaveNoTask", nil)
+
+// scheduledTaskFunction is a row of scheduled_functions joined with its task
+// function and country quotas, as seen by the Tasks loop. A NULL
+// MeasurementsRemaining means the schedule has no measurement budget.
+type scheduledTaskFunction struct {
+	ScheduleId            int
+	Id                    int
+	Name                  string
+	MaxRatePerSecond      int
+	MeasurementsRemaining sql.NullInt64
+	Weight                int
+	IncludeCountries      []string
+	ExcludeCountries      []string
+	CountryRemaining      map[string]int64
+}
+
+// weight is the function's share of traffic relative to the other scheduled
+// functions. Weights below 1 count as 1.
+func (function scheduledTaskFunction) weight() int {
+	if function.Weight < 1 {
+		return 1
+	}
+	return function.Weight
+}
+
+// tokenBucket allows rate events per second on average, with bursts of up to
+// one second's worth.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+		last:   now,
+	}
+}
+
+func (bucket *tokenBucket) take(now time.Time) bool {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.rate {
+		bucket.tokens = bucket.rate
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// refund gives back a token that take handed out but that wasn't used.
+func (bucket *tokenBucket) refund() {
+	bucket.tokens++
+	if bucket.tokens > bucket.rate {
+		bucket.tokens = bucket.rate
+	}
+}
+
+// taskFunctionSelector picks among scheduled task functions on behalf of a
+// Tasks loop, in proportion to their weights. It skips any that have used up
+// their max_rate_per_second or their measurements_remaining. Rates are
+// enforced per server instance.
+//
+// Served tasks are counted in memory and periodically written back to
+// scheduled_functions by the store, so that we don't write to the database on
+// every request. The store reloads budgets after each write, but between
+// writes every server spends from the same remaining budget, so schedules and
+// country quotas can be overshot by what the other servers serve in one
+// -served_flush_interval.
+type taskFunctionSelector struct {
+	functions        []scheduledTaskFunction
+	rand             *rand.Rand
+	buckets          map[int]*tokenBucket
+	remaining        map[int]int64
+	countryRemaining map[int]map[string]int64
+	served           servedCounts
+}
+
+// servedCounts are the numbers of tasks served from each schedule, in total
+// and by country, since they were last written to the store.
+type servedCounts struct {
+	Total     map[int]int
+	ByCountry map[int]map[string]int
+}
+
+func newServedCounts() servedCounts {
+	return servedCounts{
+		Total:     make(map[int]int),
+		ByCountry: make(map[int]map[string]int),
+	}
+}
+
+// newSchedulingRand honors -task_function_seed, so that tests can make task
+// function selection deterministic.
+func newSchedulingRand() *rand.Rand {
+	seed := *taskFunctionSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+func newTaskFunctionSelector(functions []scheduledTaskFunction, r *rand.Rand) *taskFunctionSelector {
+	selector := &taskFunctionSelector{
+		rand:    r,
+		buckets: make(map[int]*tokenBucket),
+		served:  newServedCounts(),
+	}
+	selector.reset(functions)
+	return selector
+}
+
+// reset replaces the scheduled functions after the scheduler runs or served
+// counts are flushed. Rate budgets of functions that remain scheduled carry
+// over. Flush served counts before calling reset, because measurement budgets
+// are reloaded from functions.
+func (selector *taskFunctionSelector) reset(functions []scheduledTaskFunction) {
+	selector.remaining = make(map[int]int64)
+	selector.countryRemaining = make(map[int]map[string]int64)
+	for _, function := range functions {
+		if function.MeasurementsRemaining.Valid {
+			selector.remaining[function.ScheduleId] = function.MeasurementsRemaining.Int64
+		}
+		selector.countryRemaining[function.ScheduleId] = make(map[string]int64)
+		for country, remaining := range function.CountryRemaining {
+			selector.countryRemaining[function.ScheduleId][country] = remaining
+		}
+	}
+
+	buckets := make(map[int]*tokenBucket)
+	for _, function := range functions {
+		if bucket, ok := selector.buckets[function.Id]; ok && bucket.rate == float64(function.MaxRatePerSecond) {
+			buckets[function.Id] = bucket
+		}
+	}
+	selector.buckets = buckets
+	selector.functions = functions
+}
+
+func (selector *taskFunctionSelector) allow(function scheduledTaskFunction, now time.Time) bool {
+	if function.MaxRatePerSecond <= 0 {
+		return true
+	}
+	bucket, ok := selector.buckets[function.Id]
+	if !ok {
+		bucket = newTokenBucket(float64(function.MaxRatePerSecond), now)
+		selector.buckets[function.Id] = bucket
+	}
+	return bucket.take(now)
+}
+
+func (selector *taskFunctionSelector) refund(function scheduledTaskFunction) {
+	if bucket, ok := selector.buckets[function.Id]; ok {
+		bucket.refund()
+	}
+}
+
+// candidates are the functions that target country and have measurement
+// budget to spare, and their total weight.
+func (selector *taskFunctionSelector) candidates(country string) ([]scheduledTaskFunction, int) {
+	var candidates []scheduledTaskFunction
+	totalWeight := 0
+	for _, function := range selector.functions {
+		if remaining, ok := selector.remaining[function.ScheduleId]; ok && remaining <= 0 {
+			scheduleExhaustedCounter.Inc(1)
+			continue
+		}
+		if !targetsCountry(function.IncludeCountries, function.ExcludeCountries, country) {
+			countryNotTargetedCounter.Inc(1)
+			continue
+		}
+		if remaining, ok := selector.countryRemaining[function.ScheduleId][country]; ok && remaining <= 0 {
+			countryQuotaExhaustedCounter.Inc(1)
+			continue
+		}
+		candidates = append(candidates, function)
+		totalWeight += function.weight()
+	}
+	return candidates, totalWeight
+}
+
+// choose picks the index of one of candidates in proportion to its weight.
+func (selector *taskFunctionSelector) choose(candidates []scheduledTaskFunction, totalWeight int) int {
+	choice := selector.rand.Intn(totalWeight)
+	chosen := 0
+	for ; chosen < len(candidates)-1; chosen++ {
+		if choice < candidates[chosen].weight() {
+			break
+		}
+		choice -= candidates[chosen].weight()
+	}
+	return chosen
+}
+
+// serve picks task functions by weight until one of them gives selectTask a
+// task the client may get, counts that task as served and returns it. A
+// function that is throttled, gives no task or gives a disallowed task type
+// is dropped and the rest are tried; it keeps its rate token unless it gave a
+// task. serve returns nil if nothing is scheduled or no function has a task
+// for the client.
+func (selector *taskFunctionSelector) serve(now time.Time, hints map[string]string, selectTask func(taskFunction string) *Task) *Task {
+	country := normalizeCountry(hints["country"])
+
+	candidates, totalWeight := selector.candidates(country)
+	throttled := 0
+	considered := len(candidates)
+	for len(candidates) > 0 {
+		chosen := selector.choose(candidates, totalWeight)
+		function := candidates[chosen]
+		totalWeight -= function.weight()
+		candidates = append(candidates[:chosen], candidates[chosen+1:]...)
+
+		if !selector.allow(function, now) {
+			throttled++
+			taskFunctionThrottledCounter.Inc(1)
+			metrics.GetOrRegisterCounter(fmt.Sprintf("TaskFunctionThrottled.%s", function.Name), nil).Inc(1)
+			continue
+		}
+		task := selectTask(function.Name)
+		if task != nil && !taskTypeAllowed(task, hints) {
+			disallowedTaskTypeCounter.Inc(1)
+			task = nil
+		}
+		if task == nil {
+			taskFunctionEmptyCounter.Inc(1)
+			selector.refund(function)
+			continue
+		}
+		selector.recordServed(function, country)
+		return task
+	}
+	// This happens on every request while we're throttled, so we only count
+	// it instead of logging.
+	if considered > 0 && throttled == considered {
+		allTaskFunctionsThrottledCounter.Inc(1)
+	}
+	return nil
+}
+
+// recordServed counts a task served from a schedule to a client in country
+// against its budgets.
+func (selector *taskFunctionSelector) recordServed(function scheduledTaskFunction, country string) {
+	country = normalizeCountry(country)
+
+	selector.served.Total[function.ScheduleId]++
+	if _, ok := selector.remaining[function.ScheduleId]; ok {
+		selector.remaining[function.ScheduleId]--
+	}
+	if _, ok := selector.countryRemaining[function.ScheduleId][country]; ok {
+		selector.countryRemaining[function.ScheduleId][country]--
+		if selector.served.ByCountry[function.ScheduleId] == nil {
+			selector.served.ByCountry[function.ScheduleId] = make(map[string]int)
+		}
+		selector.served.ByCountry[function.ScheduleId][country]++
+	}
+}
+
+// takeServed returns the number of tasks served from each schedule since the
+// last call.
+func (selector *taskFunctionSelector) takeServed() servedCounts {
+	served := selector.served
+	selector.served = newServedCounts()
+	return served
+}
+
+// restoreServed adds counts that takeServed returned back, so that they are
+// written by a later flush.
+func (selector *taskFunctionSelector) restoreServed(served servedCounts) {
+	for scheduleId, count := range served.Total {
+		selector.served.Total[scheduleId] += count
+	}
+	for scheduleId, countries := range served.ByCountry {
+		if selector.served.ByCountry[scheduleId] == nil {
+			selector.served.ByCountry[scheduleId] = make(map[string]int)
+		}
+		for country, count := range countries {
+			selector.served.ByCountry[scheduleId][country] += count
+		}
+	}
+}
+
+// flush writes the served counts with write and then reloads the schedules
+// with read. Counts that write fails to store are kept for the next flush,
+// and the current schedules stay in use until read succeeds.
+func (selector *taskFunctionSelector) flush(write func(servedCounts) error, read func() ([]scheduledTaskFunction, error)) {
+	served := selector.takeServed()
+	if err := write(served); err != nil {
+		selector.restoreServed(served)
+		return
+	}
+	functions, err := read()
+	if err != nil {
+		log.Printf("error reading schedules, keeping the previous ones: %v", err)
+		selectSchedulesErrorCounter.Inc(1)
+		return
+	}
+	selector.reset(functions)
+}
+
+// selectScheduledTaskFunctions reads the current schedules for a Tasks loop.
+func selectScheduledTaskFunctions(db *sql.DB) ([]scheduledTaskFunction, error) {
+	rows, err := db.Query("SELECT scheduled_functions.id, task_functions.id, task_functions.task_function, coalesce(max_rate_per_second, 0), measurements_remaining, coalesce(weight, 1), coalesce(include_countries, ''), coalesce(exclude_countries, '') FROM scheduled_functions JOIN task_functions ON scheduled_functions.task_function = task_functions.id WHERE task_functions.enabled AND (measurements_remaining IS NULL OR measurements_remaining > 0) ORDER BY task_functions.id")
+	if err != nil {
+		return nil, fmt.Errorf("error selecting schedules: %v", err)
+	}
+	var taskFunctions []scheduledTaskFunction
+	indices := make(map[int]int)
+	for rows.Next() {
+		var taskFunction scheduledTaskFunction
+		var include, exclude string
+		if err := rows.Scan(&taskFunction.ScheduleId, &taskFunction.Id, &taskFunction.Name, &taskFunction.MaxRatePerSecond, &taskFunction.MeasurementsRemaining, &taskFunction.Weight, &include, &exclude); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning task function: %v", err)
+		}
+		taskFunction.IncludeCountries = parseCountries(include)
+		taskFunction.ExcludeCountries = parseCountries(exclude)
+		taskFunction.CountryRemaining = make(map[string]int64)
+		indices[taskFunction.ScheduleId] = len(taskFunctions)
+		taskFunctions = append(taskFunctions, taskFunction)
+	}
+	if err := rows.Close(); err != nil {
+		log.Printf("error closing rows after selecting schedules: %v", err)
+	}
+
+	rows, err = db.Query("SELECT scheduled_function, country, measurements_remaining FROM scheduled_country_quotas")
+	if err != nil {
+		return nil, fmt.Errorf("error selecting country quotas: %v", err)
+	}
+	for rows.Next() {
+		var scheduleId int
+		var country string
+		var remaining int64
+		if err := rows.Scan(&scheduleId, &country, &remaining); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning country quota: %v", err)
+		}
+		if idx, ok := indices[scheduleId]; ok {
+			taskFunctions[idx].CountryRemaining[country] = remaining
+		}
+	}
+	if err := rows.Close(); err != nil {
+		log.Printf("error closing rows after selecting country quotas: %v", err)
+	}
+	return taskFunctions, nil
+}
+
+// writeServed decrements measurements_remaining of schedules and their
+// country quotas by the number of tasks served. Either every count is written
+// or none is.
+func writeServed(db *sql.DB, dialect string, served servedCounts) error {
+	if len(served.Total) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("error starting transaction: %v", err)
+		flushServedErrorCounter.Inc(1)
+		return err
+	}
+	for scheduleId, count := range served.Total {
+		if _, err := tx.Exec(rebind(dialect, "UPDATE scheduled_functions SET measurements_remaining = measurements_remaining - $1 WHERE id = $2"), count, scheduleId); err != nil {
+			log.Printf("error decrementing measurements remaining: %v", err)
+			flushServedErrorCounter.Inc(1)
+			tx.Rollback()
+			return err
+		}
+	}
+	for scheduleId, countries := range served.ByCountry {
+		for country, count := range countries {
+			if _, err := tx.Exec(rebind(dialect, "UPDATE scheduled_country_quotas SET measurements_remaining = measurements_remaining - $1 WHERE scheduled_function = $2 AND country = $3"), count, scheduleId, country); err != nil {
+				log.Printf("error decrementing country quota: %v", err)
+				flushServedErrorCounter.Inc(1)
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("error committing transaction: %v", err)
+		flushServedErrorCounter.Inc(1)
+		return err
+	}
+	return nil
+}
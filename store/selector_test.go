@@ -0,0 +1,359 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func testTask(id int, taskType string) *Task {
+	return &Task{
+		Id: id,
+		Parameters: map[string]sql.NullString{
+			"taskType": {String: taskType, Valid: true},
+		},
+	}
+}
+
+// tasksByFunction is a selectTask for serve that gives each task function's
+// task, or nil for functions it doesn't know, and counts the calls.
+type tasksByFunction struct {
+	tasks map[string]*Task
+	calls map[string]int
+}
+
+func newTasksByFunction(tasks map[string]*Task) *tasksByFunction {
+	return &tasksByFunction{
+		tasks: tasks,
+		calls: make(map[string]int),
+	}
+}
+
+func (byFunction *tasksByFunction) selectTask(taskFunction string) *Task {
+	byFunction.calls[taskFunction]++
+	return byFunction.tasks[taskFunction]
+}
+
+func TestServeRetriesFunctionsWithoutTasks(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "empty", Weight: 1000, MaxRatePerSecond: 1},
+		{ScheduleId: 2, Id: 2, Name: "full", Weight: 1},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(1)))
+	byFunction := newTasksByFunction(map[string]*Task{
+		"full": testTask(2, "img"),
+	})
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		task := selector.serve(now, map[string]string{}, byFunction.selectTask)
+		if task == nil || task.Id != 2 {
+			t.Fatalf("request %d: serve = %v, want task 2", i, task)
+		}
+	}
+	// With a rate of 1 per second, "empty" could only have been asked once
+	// if it kept the tokens it took.
+	if byFunction.calls["empty"] < 2 {
+		t.Errorf("empty was asked %d times; it should get its rate token back when it gives no task", byFunction.calls["empty"])
+	}
+	if served := selector.takeServed(); served.Total[2] != 5 || served.Total[1] != 0 {
+		t.Errorf("served = %v, want 5 tasks from schedule 2", served.Total)
+	}
+}
+
+func TestServeRetriesDisallowedTaskTypes(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "scripts", Weight: 1000},
+		{ScheduleId: 2, Id: 2, Name: "images", Weight: 1},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(1)))
+	byFunction := newTasksByFunction(map[string]*Task{
+		"scripts": testTask(1, "script"),
+		"images":  testTask(2, "img"),
+	})
+
+	hints := map[string]string{"taskTypes": "img"}
+	for i := 0; i < 5; i++ {
+		task := selector.serve(time.Now(), hints, byFunction.selectTask)
+		if task == nil || task.Id != 2 {
+			t.Fatalf("request %d: serve = %v, want task 2", i, task)
+		}
+	}
+	if served := selector.takeServed(); served.Total[1] != 0 {
+		t.Errorf("served = %v, want nothing from the disallowed schedule", served.Total)
+	}
+}
+
+func TestServeGivesUpWhenNoFunctionHasTasks(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "a"},
+		{ScheduleId: 2, Id: 2, Name: "b"},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(1)))
+	byFunction := newTasksByFunction(nil)
+
+	if task := selector.serve(time.Now(), map[string]string{}, byFunction.selectTask); task != nil {
+		t.Fatalf("serve = %v, want nil", task)
+	}
+	if byFunction.calls["a"] != 1 || byFunction.calls["b"] != 1 {
+		t.Errorf("calls = %v, want each function asked once", byFunction.calls)
+	}
+}
+
+func TestServeFollowsWeights(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "light", Weight: 1},
+		{ScheduleId: 2, Id: 2, Name: "heavy", Weight: 3},
+		// Weights below 1 count as 1.
+		{ScheduleId: 3, Id: 3, Name: "unweighted", Weight: 0},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(42)))
+	byFunction := newTasksByFunction(map[string]*Task{
+		"light":      testTask(1, "img"),
+		"heavy":      testTask(2, "img"),
+		"unweighted": testTask(3, "img"),
+	})
+
+	const requests = 10000
+	for i := 0; i < requests; i++ {
+		selector.serve(time.Now(), map[string]string{}, byFunction.selectTask)
+	}
+	served := selector.takeServed()
+	for scheduleId, want := range map[int]float64{1: 0.2, 2: 0.6, 3: 0.2} {
+		got := float64(served.Total[scheduleId]) / requests
+		if got < want-0.02 || got > want+0.02 {
+			t.Errorf("schedule %d served %.3f of tasks, want %.3f", scheduleId, got, want)
+		}
+	}
+}
+
+func TestServeIsDeterministicForASeed(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "a", Weight: 1},
+		{ScheduleId: 2, Id: 2, Name: "b", Weight: 2},
+		{ScheduleId: 3, Id: 3, Name: "c", Weight: 3},
+	}
+	tasks := map[string]*Task{
+		"a": testTask(1, "img"),
+		"b": testTask(2, "img"),
+		"c": testTask(3, "img"),
+	}
+	sequence := func() []int {
+		selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(7)))
+		byFunction := newTasksByFunction(tasks)
+		var ids []int
+		for i := 0; i < 50; i++ {
+			ids = append(ids, selector.serve(time.Now(), map[string]string{}, byFunction.selectTask).Id)
+		}
+		return ids
+	}
+	first, second := sequence(), sequence()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("request %d: got task %d then %d with the same seed", i, first[i], second[i])
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	bucket := newTokenBucket(2, start)
+	if !bucket.take(start) || !bucket.take(start) {
+		t.Fatalf("bucket should allow a burst of 2")
+	}
+	if bucket.take(start) {
+		t.Errorf("bucket allowed a third take at once")
+	}
+	if bucket.take(start.Add(250 * time.Millisecond)) {
+		t.Errorf("bucket allowed a take after refilling half a token")
+	}
+	if !bucket.take(start.Add(500 * time.Millisecond)) {
+		t.Errorf("bucket should have refilled a token after 500ms")
+	}
+	// Refills stop at one second's worth.
+	later := start.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !bucket.take(later) {
+			t.Fatalf("take %d after an hour failed", i)
+		}
+	}
+	if bucket.take(later) {
+		t.Errorf("bucket allowed more than its burst after an hour")
+	}
+	bucket.refund()
+	if !bucket.take(later) {
+		t.Errorf("refunded token wasn't available")
+	}
+}
+
+func TestServeThrottlesByRate(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "limited", Weight: 1, MaxRatePerSecond: 3},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(1)))
+	byFunction := newTasksByFunction(map[string]*Task{
+		"limited": testTask(1, "img"),
+	})
+
+	now := time.Now()
+	served := 0
+	for i := 0; i < 10; i++ {
+		if selector.serve(now, map[string]string{}, byFunction.selectTask) != nil {
+			served++
+		}
+	}
+	if served != 3 {
+		t.Errorf("served %d tasks in an instant, want 3", served)
+	}
+	later := now.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		if selector.serve(later, map[string]string{}, byFunction.selectTask) == nil {
+			t.Fatalf("request %d a second later got no task", i)
+		}
+	}
+
+	// Rate budgets survive a reset that keeps the function scheduled.
+	selector.reset(functions)
+	if selector.serve(later, map[string]string{}, byFunction.selectTask) != nil {
+		t.Errorf("reset refilled the rate budget")
+	}
+}
+
+func TestServeExhaustsMeasurementsRemaining(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "budgeted", Weight: 1, MeasurementsRemaining: sql.NullInt64{Int64: 2, Valid: true}},
+		{ScheduleId: 2, Id: 2, Name: "fallback", Weight: 1},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(1)))
+	byFunction := newTasksByFunction(map[string]*Task{
+		"budgeted": testTask(1, "img"),
+		"fallback": testTask(2, "img"),
+	})
+
+	for i := 0; i < 100; i++ {
+		if selector.serve(time.Now(), map[string]string{}, byFunction.selectTask) == nil {
+			t.Fatalf("request %d got no task", i)
+		}
+	}
+	served := selector.takeServed()
+	if served.Total[1] != 2 || served.Total[2] != 98 {
+		t.Errorf("served = %v, want 2 from the budgeted schedule and 98 from the other", served.Total)
+	}
+
+	// Once the store has written the counts back, the reloaded schedule has
+	// nothing left either.
+	functions[0].MeasurementsRemaining.Int64 = 0
+	selector.reset(functions)
+	for i := 0; i < 10; i++ {
+		if task := selector.serve(time.Now(), map[string]string{}, byFunction.selectTask); task == nil || task.Id != 2 {
+			t.Fatalf("request %d after reset: serve = %v, want task 2", i, task)
+		}
+	}
+}
+
+func TestServeExhaustsCountryQuotas(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "quota", Weight: 1, CountryRemaining: map[string]int64{"US": 1}},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(1)))
+	byFunction := newTasksByFunction(map[string]*Task{
+		"quota": testTask(1, "img"),
+	})
+
+	us := map[string]string{"country": "us"}
+	if selector.serve(time.Now(), us, byFunction.selectTask) == nil {
+		t.Fatalf("first US request got no task")
+	}
+	if selector.serve(time.Now(), us, byFunction.selectTask) != nil {
+		t.Errorf("second US request got a task past the quota")
+	}
+	if selector.serve(time.Now(), map[string]string{"country": "CA"}, byFunction.selectTask) == nil {
+		t.Errorf("countries without a quota should still get tasks")
+	}
+	if served := selector.takeServed(); served.ByCountry[1]["US"] != 1 {
+		t.Errorf("served by country = %v, want 1 for US", served.ByCountry)
+	}
+}
+
+func TestFlushKeepsStateOnErrors(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "quota", Weight: 1, CountryRemaining: map[string]int64{"US": 10}},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(1)))
+	byFunction := newTasksByFunction(map[string]*Task{
+		"quota": testTask(1, "img"),
+	})
+	serve := func(count int) {
+		for i := 0; i < count; i++ {
+			if selector.serve(time.Now(), map[string]string{"country": "US"}, byFunction.selectTask) == nil {
+				t.Fatalf("request %d got no task", i)
+			}
+		}
+	}
+	readSchedules := func() ([]scheduledTaskFunction, error) {
+		t.Errorf("schedules reloaded after the counts failed to write")
+		return nil, nil
+	}
+
+	// Counts that fail to write are kept and added to later ones.
+	serve(2)
+	selector.flush(func(servedCounts) error { return errors.New("write failed") }, readSchedules)
+	serve(1)
+	var written servedCounts
+	selector.flush(func(served servedCounts) error {
+		written = served
+		return errors.New("write failed again")
+	}, readSchedules)
+	if written.Total[1] != 3 || written.ByCountry[1]["US"] != 3 {
+		t.Errorf("second flush wrote %v, want 3 tasks for US from schedule 1", written)
+	}
+
+	// Once the counts are written, a failed read keeps the old schedules.
+	selector.flush(func(served servedCounts) error {
+		written = served
+		return nil
+	}, func() ([]scheduledTaskFunction, error) {
+		return nil, errors.New("read failed")
+	})
+	if written.Total[1] != 3 || written.ByCountry[1]["US"] != 3 {
+		t.Errorf("third flush wrote %v, want 3 tasks for US from schedule 1", written)
+	}
+	if served := selector.takeServed(); len(served.Total) != 0 {
+		t.Errorf("written counts were kept: %v", served.Total)
+	}
+	serve(1)
+}
+
+func TestServeCountsAllThrottledOnlyWhenRatesRefuse(t *testing.T) {
+	functions := []scheduledTaskFunction{
+		{ScheduleId: 1, Id: 1, Name: "limited", Weight: 1, MaxRatePerSecond: 1},
+		{ScheduleId: 2, Id: 2, Name: "empty", Weight: 1, IncludeCountries: []string{"US"}},
+	}
+	selector := newTaskFunctionSelector(functions, rand.New(rand.NewSource(1)))
+	byFunction := newTasksByFunction(map[string]*Task{
+		"limited": testTask(1, "img"),
+	})
+	serve := func(country string) int64 {
+		before := allTaskFunctionsThrottledCounter.Count()
+		selector.serve(time.Now(), map[string]string{"country": country}, byFunction.selectTask)
+		return allTaskFunctionsThrottledCounter.Count() - before
+	}
+
+	if counted := serve("CA"); counted != 0 {
+		t.Errorf("counted a served request as throttled")
+	}
+	if counted := serve("US"); counted != 0 {
+		t.Errorf("counted as throttled when a function had no task")
+	}
+	if counted := serve("CA"); counted != 1 {
+		t.Errorf("counted %d when the only candidate was throttled, want 1", counted)
+	}
+	if counted := serve("BR"); counted != 1 {
+		t.Errorf("counted %d when the untargeted function was skipped, want 1", counted)
+	}
+	if counted := serve("US"); counted != 0 {
+		t.Errorf("counted with an empty but unthrottled function")
+	}
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var disallowedTaskTypeCounter = metrics.GetOrRegisterCounter("DisallowedTaskType", nil)
+
+// These implement the site registration parts of Store for the SQL backends.
+// In the database, allowed_task_types is a comma separated list of taskType
+// parameters.
+
+func parseTaskTypes(taskTypes string) []string {
+	var parsed []string
+	for _, taskType := range strings.Split(taskTypes, ",") {
+		if taskType = strings.TrimSpace(taskType); taskType != "" {
+			parsed = append(parsed, taskType)
+		}
+	}
+	return parsed
+}
+
+func normalizeTaskTypes(taskTypes []string) []string {
+	return parseTaskTypes(strings.Join(taskTypes, ","))
+}
+
+func formatTaskTypes(taskTypes []string) string {
+	return strings.Join(normalizeTaskTypes(taskTypes), ",")
+}
+
+// taskTypeAllowed reports whether task's taskType is in the comma separated
+// "taskTypes" hint. The task server sets the hint from the site's
+// allowed_task_types; task functions in the database can read it too.
+func taskTypeAllowed(task *Task, hints map[string]string) bool {
+	allowed := parseTaskTypes(hints["taskTypes"])
+	if len(allowed) == 0 {
+		return true
+	}
+	taskType, ok := task.Parameters["taskType"]
+	if !ok || !taskType.Valid {
+		return false
+	}
+	for _, allowedType := range allowed {
+		if taskType.String == allowedType {
+			return true
+		}
+	}
+	return false
+}
+
+func selectSites(db *sql.DB) ([]Site, error) {
+	rows, err := db.Query("SELECT id, site_key, coalesce(name, ''), coalesce(contact_email, ''), coalesce(allowed_task_types, ''), coalesce(show_stats, false), coalesce(enabled, false), coalesce(runtime, '') FROM sites ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sites []Site
+	for rows.Next() {
+		var site Site
+		var taskTypes string
+		if err := rows.Scan(&site.Id, &site.Key, &site.Name, &site.ContactEmail, &taskTypes, &site.ShowStats, &site.Enabled, &site.Runtime); err != nil {
+			return nil, err
+		}
+		site.AllowedTaskTypes = parseTaskTypes(taskTypes)
+		sites = append(sites, site)
+	}
+	return sites, rows.Err()
+}
+
+func insertSite(db *sql.DB, dialect string, site Site) (int, error) {
+	var id int
+	row := db.QueryRow(rebind(dialect, "INSERT INTO sites (site_key, name, contact_email, allowed_task_types, show_stats, enabled, runtime) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id"),
+		site.Key,
+		site.Name,
+		site.ContactEmail,
+		formatTaskTypes(site.AllowedTaskTypes),
+		site.ShowStats,
+		site.Enabled,
+		site.Runtime)
+	if err := row.Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func updateSite(db *sql.DB, dialect string, site Site) error {
+	result, err := db.Exec(rebind(dialect, "UPDATE sites SET site_key = $1, name = $2, contact_email = $3, allowed_task_types = $4, show_stats = $5, enabled = $6, runtime = $7 WHERE id = $8"),
+		site.Key,
+		site.Name,
+		site.ContactEmail,
+		formatTaskTypes(site.AllowedTaskTypes),
+		site.ShowStats,
+		site.Enabled,
+		site.Runtime,
+		site.Id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// statsStatement picks the statement that answers a statistics request, and
+// its argument, depending on whether the request is for a site or a referer.
+func statsStatement(byReferer, bySite *sql.Stmt, referer string, site int) (*sql.Stmt, interface{}) {
+	if site != 0 {
+		return bySite, site
+	}
+	return byReferer, referer
+}
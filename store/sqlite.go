@@ -0,0 +1,774 @@
+package store
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rcrowley/go-metrics"
+)
+
+var loadTasksErrorCounter = metrics.GetOrRegisterCounter("LoadTasksError", nil)
+
+// sqliteStore implements Store for small deployments that don't warrant a
+// Postgres server. SQLite has neither hstore nor PL/pgSQL, so parameters are
+// stored as JSON and task functions are TaskFilters registered in Go.
+// Scheduler timestamps are stored as Unix seconds.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// jsonParameters is the SQLite stand-in for an hstore column.
+type jsonParameters map[string]sql.NullString
+
+func (parameters jsonParameters) Value() (driver.Value, error) {
+	values := make(map[string]*string)
+	for k, v := range parameters {
+		if !v.Valid {
+			values[k] = nil
+			continue
+		}
+		s := v.String
+		values[k] = &s
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+func (parameters *jsonParameters) Scan(value interface{}) error {
+	var encoded []byte
+	switch v := value.(type) {
+	case nil:
+		*parameters = nil
+		return nil
+	case []byte:
+		encoded = v
+	case string:
+		encoded = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into parameters", value)
+	}
+
+	var values map[string]*string
+	if err := json.Unmarshal(encoded, &values); err != nil {
+		return err
+	}
+	*parameters = make(jsonParameters)
+	for k, v := range values {
+		if v == nil {
+			(*parameters)[k] = sql.NullString{}
+			continue
+		}
+		(*parameters)[k] = sql.NullString{
+			String: *v,
+			Valid:  true,
+		}
+	}
+	return nil
+}
+
+// openSqlite enables WAL and a busy timeout unless the DSN already has
+// options, because the parser reads and writes the database concurrently.
+func openSqlite(dataSourceName string) Store {
+	if !strings.Contains(dataSourceName, "?") {
+		dataSourceName += "?_journal_mode=WAL&_busy_timeout=5000"
+	}
+	db, err := sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		log.Fatalf("error opening database %s: %v", dataSourceName, err)
+	}
+	return &sqliteStore{
+		db: db,
+	}
+}
+
+func (store *sqliteStore) Close() {
+	store.db.Close()
+}
+
+func (store *sqliteStore) SchemaVersion() (int, error) {
+	version, _, err := databaseSchemaVersion(store.db, sqliteDialect)
+	return version, err
+}
+
+func (store *sqliteStore) Migrate() error {
+	return migrateDatabase(store.db, sqliteDialect)
+}
+
+func insertSqliteTaskFunctions(tx *sql.Tx, now time.Time) error {
+	var minTaskFunction, minPriority int
+	row := tx.QueryRow("SELECT task_function, priority FROM scheduled_functions ORDER BY scheduled_time DESC, priority DESC, task_function DESC LIMIT 1")
+	if err := row.Scan(&minTaskFunction, &minPriority); err == sql.ErrNoRows {
+		log.Printf("no prior functions scheduled")
+		noPriorFunctionsScheduledCounter.Inc(1)
+	} else if err != nil {
+		log.Printf("error finding max last priority: %v", err)
+		lastMaxPriorityErrorCounter.Inc(1)
+		return err
+	}
+
+	log.Printf("min task function: %v, min priority: %v", minTaskFunction, minPriority)
+
+	if _, err := tx.Exec("DELETE FROM scheduled_functions WHERE expiration_time < ? OR measurements_remaining <= 0 OR task_function IN (SELECT id FROM task_functions WHERE NOT coalesce(enabled, 0))", now.Unix()); err != nil {
+		log.Printf("error deleting expired task functions: %v", err)
+		deleteExpiredFunctionsErrorCounter.Inc(1)
+		return err
+	}
+	if err := deleteExhaustedSchedules(tx, sqliteDialect); err != nil {
+		return err
+	}
+
+	var toSchedule int
+	row = tx.QueryRow("SELECT concurrent_functions - scheduled FROM (SELECT count(1) scheduled FROM scheduled_functions) AS c, scheduler_configuration")
+	if err := row.Scan(&toSchedule); err != nil {
+		log.Printf("error counting scheduled tasks: %v", err)
+		countSchedluedTasksErrorCounter.Inc(1)
+		return err
+	}
+	// SQLite treats a negative LIMIT as no limit at all.
+	if toSchedule < 0 {
+		toSchedule = 0
+	}
+
+	result, err := tx.Exec("INSERT INTO scheduled_functions (task_function, expiration_time, measurements_remaining, priority, scheduled_time) SELECT id, ? + max_duration_seconds, max_measurements, priority, ? FROM task_functions WHERE enabled AND ((priority = ? AND id > ?) OR priority > ?) ORDER BY priority, id LIMIT ?", now.Unix(), now.Unix(), minPriority, minTaskFunction, minPriority, toSchedule)
+	if err != nil {
+		log.Printf("error inserting new schedules: %v", err)
+		insertScheduledFunctionsErrorCounter.Inc(1)
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		log.Printf("error discovering number of affected rows: %v", err)
+		countScheduledFunctionsErrorCounter.Inc(1)
+		return err
+	}
+	toSchedule -= int(rowsAffected)
+	result, err = tx.Exec("INSERT INTO scheduled_functions (task_function, expiration_time, measurements_remaining, priority, scheduled_time) SELECT id, ? + max_duration_seconds, max_measurements, priority, ? FROM task_functions WHERE enabled ORDER BY priority, id LIMIT ?", now.Unix(), now.Unix(), toSchedule)
+	if err != nil {
+		log.Printf("error inserting new schedules: %v", err)
+		insertScheduledFunctionsErrorCounter.Inc(1)
+		return err
+	}
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		log.Printf("error discovering number of affected rows: %v", err)
+		countScheduledFunctionsErrorCounter.Inc(1)
+		return err
+	}
+	toSchedule -= int(rowsAffected)
+	if err := insertCountryQuotas(tx, sqliteDialect); err != nil {
+		return err
+	}
+	if toSchedule > 0 {
+		log.Printf("unable to fill schedule")
+		unfilledScheduleCounter.Inc(1)
+	}
+	return nil
+}
+
+func (store *sqliteStore) ScheduleTaskFunctions() {
+	schedulerLeaderGauge().Update(1)
+	schedule := func() {
+		tx, err := store.db.Begin()
+		if err != nil {
+			log.Printf("error starting transaction: %v", err)
+			return
+		}
+		if err := insertSqliteTaskFunctions(tx, time.Now()); err != nil {
+			tx.Rollback()
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("error committing transaction: %v", err)
+			return
+		}
+	}
+
+	schedule()
+	for _ = range time.Tick(*schedulingInterval) {
+		schedule()
+	}
+}
+
+func (store *sqliteStore) TaskFunctions() ([]TaskFunction, error) {
+	return selectTaskFunctions(store.db)
+}
+
+func (store *sqliteStore) CreateTaskFunction(taskFunction TaskFunction) (int, error) {
+	return insertTaskFunction(store.db, sqliteDialect, taskFunction)
+}
+
+func (store *sqliteStore) UpdateTaskFunction(taskFunction TaskFunction) error {
+	return updateTaskFunction(store.db, sqliteDialect, taskFunction)
+}
+
+func (store *sqliteStore) ConcurrentFunctions() (int, error) {
+	return selectConcurrentFunctions(store.db)
+}
+
+func (store *sqliteStore) SetConcurrentFunctions(concurrentFunctions int) error {
+	return updateConcurrentFunctions(store.db, sqliteDialect, concurrentFunctions)
+}
+
+func (store *sqliteStore) Schedules() ([]Schedule, error) {
+	return selectSchedules(store.db)
+}
+
+func (store *sqliteStore) Sites() ([]Site, error) {
+	return selectSites(store.db)
+}
+
+func (store *sqliteStore) CreateSite(site Site) (int, error) {
+	return insertSite(store.db, sqliteDialect, site)
+}
+
+func (store *sqliteStore) UpdateSite(site Site) error {
+	return updateSite(store.db, sqliteDialect, site)
+}
+
+// loadTasks decodes every task, so that selectTask needn't scan and decode
+// the tasks table on each request.
+func (store *sqliteStore) loadTasks(selectStmt *sql.Stmt) ([]*Task, error) {
+	rows, err := selectStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+	for rows.Next() {
+		var task Task
+		var parameters jsonParameters
+		if err := rows.Scan(&task.Id, &parameters); err != nil {
+			return nil, err
+		}
+		task.Parameters = parameters
+		tasks = append(tasks, &task)
+	}
+	return tasks, rows.Err()
+}
+
+// selectTask picks a random task accepted by the task function's filter, like
+// "SELECT ... FROM task_functions.f($1) ORDER BY random() LIMIT 1" does in
+// Postgres.
+func (store *sqliteStore) selectTask(tasks []*Task, taskFunction string, hints map[string]string) *Task {
+	filter, ok := lookupTaskFilter(taskFunction)
+	if !ok {
+		log.Printf("no task filter registered for task function %q", taskFunction)
+		return nil
+	}
+
+	var candidates []*Task
+	for _, task := range tasks {
+		if filter(task, hints) && taskTypeAllowed(task, hints) {
+			candidates = append(candidates, task)
+		}
+	}
+	if len(candidates) == 0 {
+		emptyTaskFunctionCounter.Inc(1)
+		return nil
+	}
+	return copyTask(candidates[rand.Intn(len(candidates))])
+}
+
+// Tasks serves tasks from a copy of the tasks table that it reloads every
+// -scheduling_interval, so new tasks take up to that long to be served.
+func (store *sqliteStore) Tasks(taskRequests <-chan *TaskRequest) {
+	updateTicker := time.Tick(*schedulingInterval)
+	flushTicker := time.Tick(*servedFlushInterval)
+
+	tasksStmt, err := store.db.Prepare("SELECT id, parameters FROM tasks")
+	if err != nil {
+		log.Fatalf("error preparing tasks select statement: %v", err)
+	}
+	tasks, err := store.loadTasks(tasksStmt)
+	if err != nil {
+		log.Fatalf("error loading tasks: %v", err)
+	}
+
+	functions, err := selectScheduledTaskFunctions(store.db)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	selector := newTaskFunctionSelector(functions, newSchedulingRand())
+	writeCounts := func(served servedCounts) error {
+		return writeServed(store.db, sqliteDialect, served)
+	}
+	readSchedules := func() ([]scheduledTaskFunction, error) {
+		return selectScheduledTaskFunctions(store.db)
+	}
+	for {
+		select {
+		case taskRequest := <-taskRequests:
+			task := selector.serve(time.Now(), taskRequest.Hints, func(taskFunction string) *Task {
+				return store.selectTask(tasks, taskFunction, taskRequest.Hints)
+			})
+			select {
+			case taskRequest.Response <- task:
+			case <-time.After(time.Second):
+				log.Printf("task response timed out")
+			}
+			close(taskRequest.Response)
+
+		case <-flushTicker:
+			selector.flush(writeCounts, readSchedules)
+
+		case <-updateTicker:
+			selector.flush(writeCounts, readSchedules)
+			if reloaded, err := store.loadTasks(tasksStmt); err != nil {
+				log.Printf("error reloading tasks: %v", err)
+				loadTasksErrorCounter.Inc(1)
+			} else {
+				tasks = reloaded
+			}
+		}
+	}
+}
+
+func (store *sqliteStore) WriteTasks(tasks <-chan *Task) {
+	tasksStmt, err := store.db.Prepare("INSERT INTO tasks (parameters) VALUES (?)")
+	if err != nil {
+		log.Fatalf("error preparing tasks insert statement: %v", err)
+	}
+	defer tasksStmt.Close()
+
+	for task := range tasks {
+		if _, err := tasksStmt.Exec(jsonParameters(task.Parameters)); err != nil {
+			log.Printf("error inserting task: %v", err)
+		}
+	}
+
+	if err := tasksStmt.Close(); err != nil {
+		log.Printf("error while closing tasks insert statement: %v", err)
+	}
+}
+
+// AllTasks returns every row of tasks, in id order.
+func (store *sqliteStore) AllTasks() <-chan *Task {
+	tasks := make(chan *Task)
+	go func() {
+		defer close(tasks)
+		rows, err := store.db.Query("SELECT id, parameters FROM tasks ORDER BY id")
+		if err != nil {
+			log.Fatalf("error selecting tasks: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var task Task
+			var parameters jsonParameters
+			if err := rows.Scan(&task.Id, &parameters); err != nil {
+				log.Fatalf("error scanning task: %v", err)
+			}
+			task.Parameters = parameters
+			tasks <- &task
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatalf("error selecting tasks: %v", err)
+		}
+	}()
+	return tasks
+}
+
+// InsertTasks inserts tasks in a single transaction and returns their ids.
+func (store *sqliteStore) InsertTasks(tasks []*Task) ([]int, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, task := range tasks {
+		result, err := tx.Exec("INSERT INTO tasks (parameters) VALUES (?)", jsonParameters(task.Parameters))
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		ids = append(ids, int(id))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (store *sqliteStore) WriteQueries(queries <-chan *Query) {
+	queriesStmt, err := store.db.Prepare("INSERT INTO queries (timestamp, client_ip, task, raw_request, substrate, parameters_json, response_body, template_hash, git_revision, site) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		log.Fatalf("error preparing queries insert statement: %v", err)
+	}
+	defer queriesStmt.Close()
+
+	for query := range queries {
+		if _, err := queriesStmt.Exec(query.Timestamp, query.RemoteAddr, nullIfZero(query.Task), query.RawRequest, query.Substrate, query.ParametersJson, query.ResponseBody, query.TemplateHash, query.GitRevision, nullIfZero(query.Site)); err != nil {
+			log.Printf("error inserting query: %v", err)
+			continue
+		}
+	}
+
+	if err := queriesStmt.Close(); err != nil {
+		log.Printf("error while closing queries insert statement: %v", err)
+	}
+}
+
+func (store *sqliteStore) selectQueries(statement string) <-chan *Query {
+	queries := make(chan *Query)
+	go func() {
+		defer close(queries)
+
+		rows, err := store.db.Query(statement)
+		if err != nil {
+			log.Fatalf("error selecting queries: %v", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var query Query
+			if err := rows.Scan(&query.Id, &query.Timestamp, &query.RemoteAddr, &query.Task, &query.RawRequest, &query.Substrate, &query.ParametersJson, &query.TemplateHash, &query.GitRevision, &query.Site); err != nil {
+				log.Printf("error reading query: %v", err)
+			}
+			queries <- &query
+		}
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows after reading queries: %v", err)
+		}
+	}()
+	return queries
+}
+
+func (store *sqliteStore) Queries() <-chan *Query {
+	return store.selectQueries("SELECT id, timestamp, client_ip, coalesce(task, 0), raw_request, substrate, parameters_json, coalesce(template_hash, ''), coalesce(git_revision, ''), coalesce(site, 0) FROM queries")
+}
+
+func (store *sqliteStore) UnparsedQueries() <-chan *Query {
+	return store.selectQueries("SELECT id, timestamp, client_ip, coalesce(task, 0), raw_request, substrate, parameters_json, coalesce(template_hash, ''), coalesce(git_revision, ''), coalesce(site, 0) FROM queries WHERE NOT EXISTS (SELECT NULL FROM parsed_queries WHERE query = id)")
+}
+
+func (store *sqliteStore) WriteParsedQueries(parsedQueries <-chan *ParsedQuery) {
+	insertIntoQueries, err := store.db.Prepare(`INSERT INTO parsed_queries (query, measurement_id, timestamp, client_ip, client_location, client_asn, client_organization, client_city, substrate, parameters, template_hash, git_revision, site) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		log.Fatalf("error preparing parsed_queries insert statement: %v", err)
+	}
+	defer insertIntoQueries.Close()
+
+	for parsedQuery := range parsedQueries {
+		if _, err := insertIntoQueries.Exec(parsedQuery.Query, parsedQuery.MeasurementId, parsedQuery.Timestamp, parsedQuery.ClientIp.String(), parsedQuery.ClientLocation, nullIfZero(parsedQuery.ClientAsn), parsedQuery.ClientOrganization, parsedQuery.ClientCity, parsedQuery.Substrate, jsonParameters(parsedQuery.Parameters), parsedQuery.TemplateHash, parsedQuery.GitRevision, nullIfZero(parsedQuery.Site)); err != nil {
+			log.Printf("error inserting parsed query: %v", err)
+		}
+	}
+
+	if err := insertIntoQueries.Close(); err != nil {
+		log.Printf("error while closing parsed queries insert statement: %v", err)
+	}
+}
+
+func (store *sqliteStore) WriteResults(results <-chan *Result) {
+	resultsStmt, err := store.db.Prepare("INSERT INTO results (timestamp, client_ip, raw_request, authenticated) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		log.Fatalf("error preparing results insert statement: %v", err)
+	}
+	defer resultsStmt.Close()
+
+	for result := range results {
+		if _, err := resultsStmt.Exec(result.Timestamp, result.RemoteAddr, result.RawRequest, result.Authenticated); err != nil {
+			log.Printf("error inserting result: %v", err)
+			continue
+		}
+	}
+
+	if err := resultsStmt.Close(); err != nil {
+		log.Printf("error while closing results insert statement: %v", err)
+	}
+}
+
+func (store *sqliteStore) selectResults(statement string) <-chan *Result {
+	results := make(chan *Result)
+	go func() {
+		defer close(results)
+
+		rows, err := store.db.Query(statement)
+		if err != nil {
+			log.Fatalf("error selecting results: %v", err)
+		}
+		for rows.Next() {
+			var result Result
+			if err := rows.Scan(&result.Id, &result.Timestamp, &result.RemoteAddr, &result.RawRequest, &result.Authenticated); err != nil {
+				log.Printf("error scanning result: %v", err)
+			}
+			results <- &result
+		}
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows after selecting results: %v", err)
+		}
+	}()
+	return results
+}
+
+func (store *sqliteStore) Results() <-chan *Result {
+	return store.selectResults("SELECT id, timestamp, client_ip, raw_request, authenticated FROM results")
+}
+
+func (store *sqliteStore) UnparsedResults() <-chan *Result {
+	return store.selectResults("SELECT id, timestamp, client_ip, raw_request, authenticated FROM results WHERE coalesce(authenticated, true) AND NOT EXISTS (SELECT NULL FROM parsed_results WHERE result = id)")
+}
+
+func (store *sqliteStore) WriteParsedResults(parsedResults <-chan *ParsedResult) {
+	insertIntoResults, err := store.db.Prepare("INSERT INTO parsed_results (result, measurement_id, timestamp, outcome, message, origin, referer, client_ip, client_location, client_asn, client_organization, client_city, user_agent, timing_dns, timing_connect, timing_tls, timing_request, timing_response, timing_duration, sub_target) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		log.Fatalf("error preparing parsed_results insertion statement: %v", err)
+	}
+	defer insertIntoResults.Close()
+
+	for parsedResult := range parsedResults {
+		if _, err := insertIntoResults.Exec(parsedResult.Result, parsedResult.MeasurementId, parsedResult.Timestamp, parsedResult.Outcome, parsedResult.Message, parsedResult.Origin, parsedResult.Referer, parsedResult.ClientIp.String(), parsedResult.ClientLocation, nullIfZero(parsedResult.ClientAsn), parsedResult.ClientOrganization, parsedResult.ClientCity, parsedResult.UserAgent, parsedResult.TimingDns, parsedResult.TimingConnect, parsedResult.TimingTls, parsedResult.TimingRequest, parsedResult.TimingResponse, parsedResult.TimingDuration, parsedResult.SubTarget); err != nil {
+			log.Printf("error inserting parsed result: %v", err)
+		}
+	}
+
+	if err := insertIntoResults.Close(); err != nil {
+		log.Printf("error while closing parsed results insert statement: %v", err)
+	}
+}
+
+func (store *sqliteStore) WriteOptOuts(optOuts <-chan *OptOut) {
+	optOutsStmt, err := store.db.Prepare("INSERT INTO opt_outs (timestamp, referer, reason, site) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		log.Fatalf("error preparing opt-outs insert statement: %v", err)
+	}
+	defer optOutsStmt.Close()
+
+	for optOut := range optOuts {
+		if _, err := optOutsStmt.Exec(optOut.Timestamp, optOut.Referer, optOut.Reason, nullIfZero(optOut.Site)); err != nil {
+			log.Printf("error inserting opt-out: %v", err)
+			continue
+		}
+	}
+
+	if err := optOutsStmt.Close(); err != nil {
+		log.Printf("error while closing opt-outs insert statement: %v", err)
+	}
+}
+
+func (store *sqliteStore) execInTransaction(statements ...string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ComputeResultsTables groups days by the date prefix of the stored
+// timestamp, which is the server's local date like Postgres' timestamp::date.
+func (store *sqliteStore) ComputeResultsTables() error {
+	if err := store.execInTransaction(
+		"DROP TABLE IF EXISTS results_per_referer",
+		"CREATE TABLE results_per_referer AS SELECT referer, count(distinct measurement_id) results FROM parsed_results WHERE outcome = 'init' GROUP BY referer",
+		"CREATE INDEX results_per_referer_referer ON results_per_referer (referer)",
+	); err != nil {
+		return err
+	}
+
+	if err := store.execInTransaction(
+		"DROP TABLE IF EXISTS results_per_day",
+		`CREATE TABLE results_per_day AS SELECT referer, substr("timestamp", 1, 10) AS day, count(distinct measurement_id) results FROM parsed_results WHERE outcome = 'init' GROUP BY referer, substr("timestamp", 1, 10)`,
+		"CREATE INDEX results_per_day_referer ON results_per_day (referer)",
+	); err != nil {
+		return err
+	}
+
+	if err := store.execInTransaction(
+		"DROP TABLE IF EXISTS results_per_country",
+		"CREATE TABLE results_per_country AS SELECT referer, client_location country, count(distinct measurement_id) results FROM parsed_results WHERE outcome = 'init' GROUP BY referer, client_location",
+		"CREATE INDEX results_per_country_referer ON results_per_country (referer)",
+	); err != nil {
+		return err
+	}
+
+	// Results belong to the site of the query that gave out their
+	// measurement id.
+	if err := store.execInTransaction(
+		"DROP TABLE IF EXISTS site_results",
+		"CREATE TABLE site_results AS SELECT parsed_queries.site, count(distinct parsed_results.measurement_id) results FROM parsed_results JOIN parsed_queries ON parsed_queries.measurement_id = parsed_results.measurement_id WHERE parsed_results.outcome = 'init' AND parsed_queries.site IS NOT NULL GROUP BY parsed_queries.site",
+		"CREATE INDEX site_results_site ON site_results (site)",
+	); err != nil {
+		return err
+	}
+
+	if err := store.execInTransaction(
+		"DROP TABLE IF EXISTS site_results_per_day",
+		`CREATE TABLE site_results_per_day AS SELECT parsed_queries.site, substr(parsed_results."timestamp", 1, 10) AS day, count(distinct parsed_results.measurement_id) results FROM parsed_results JOIN parsed_queries ON parsed_queries.measurement_id = parsed_results.measurement_id WHERE parsed_results.outcome = 'init' AND parsed_queries.site IS NOT NULL GROUP BY parsed_queries.site, substr(parsed_results."timestamp", 1, 10)`,
+		"CREATE INDEX site_results_per_day_site ON site_results_per_day (site)",
+	); err != nil {
+		return err
+	}
+
+	if err := store.execInTransaction(
+		"DROP TABLE IF EXISTS site_results_per_country",
+		"CREATE TABLE site_results_per_country AS SELECT parsed_queries.site, parsed_results.client_location country, count(distinct parsed_results.measurement_id) results FROM parsed_results JOIN parsed_queries ON parsed_queries.measurement_id = parsed_results.measurement_id WHERE parsed_results.outcome = 'init' AND parsed_queries.site IS NOT NULL GROUP BY parsed_queries.site, parsed_results.client_location",
+		"CREATE INDEX site_results_per_country_site ON site_results_per_country (site)",
+	); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (store *sqliteStore) CountResultsForReferrer(requests <-chan CountResultsRequest) {
+	query, err := store.db.Prepare("SELECT results FROM results_per_referer WHERE referer = ?")
+	if err != nil {
+		log.Fatalf("error preparing result count statement: %v", err)
+	}
+	siteQuery, err := store.db.Prepare("SELECT results FROM site_results WHERE site = ?")
+	if err != nil {
+		log.Fatalf("error preparing site result count statement: %v", err)
+	}
+
+	for request := range requests {
+		statement, key := statsStatement(query, siteQuery, request.Referer, request.Site)
+		row := statement.QueryRow(key)
+		var count int
+		if err := row.Scan(&count); err != nil {
+			log.Printf("error scanning result count %v: %v", key, err)
+			request.Response <- CountResultsResponse{
+				Err: err,
+			}
+			continue
+		}
+		request.Response <- CountResultsResponse{
+			Count: count,
+			Err:   nil,
+		}
+	}
+
+	if err := query.Close(); err != nil {
+		log.Printf("error while closing results query: %v", err)
+	}
+	if err := siteQuery.Close(); err != nil {
+		log.Printf("error while closing site results query: %v", err)
+	}
+}
+
+func (store *sqliteStore) CountOptOutsForReferrer(requests <-chan CountResultsRequest) {
+	query, err := store.db.Prepare("SELECT count(1) FROM opt_outs WHERE referer = ?")
+	if err != nil {
+		log.Fatalf("error preparing opt-out count statement: %v", err)
+	}
+	siteQuery, err := store.db.Prepare("SELECT count(1) FROM opt_outs WHERE site = ?")
+	if err != nil {
+		log.Fatalf("error preparing site opt-out count statement: %v", err)
+	}
+
+	for request := range requests {
+		statement, key := statsStatement(query, siteQuery, request.Referer, request.Site)
+		row := statement.QueryRow(key)
+		var count int
+		if err := row.Scan(&count); err != nil {
+			log.Printf("error scanning opt-out count %v: %v", key, err)
+			request.Response <- CountResultsResponse{
+				Err: err,
+			}
+			continue
+		}
+		request.Response <- CountResultsResponse{
+			Count: count,
+			Err:   nil,
+		}
+	}
+
+	if err := query.Close(); err != nil {
+		log.Printf("error while closing opt-outs query: %v", err)
+	}
+	if err := siteQuery.Close(); err != nil {
+		log.Printf("error while closing site opt-outs query: %v", err)
+	}
+}
+
+// queryCounts runs a query returning (key, count) rows for a referer or site.
+func queryCounts(query *sql.Stmt, key interface{}) (map[string]int, error) {
+	rows, err := query.Query(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+		results[key] = count
+	}
+	return results, rows.Err()
+}
+
+func (store *sqliteStore) ResultsPerDayForReferrer(requests <-chan ResultsPerDayRequest) {
+	query, err := store.db.Prepare("SELECT day, results FROM results_per_day WHERE referer = ? ORDER BY day")
+	if err != nil {
+		log.Fatalf("error preparing result count statement: %v", err)
+	}
+	siteQuery, err := store.db.Prepare("SELECT day, results FROM site_results_per_day WHERE site = ? ORDER BY day")
+	if err != nil {
+		log.Fatalf("error preparing site result count statement: %v", err)
+	}
+
+	for request := range requests {
+		results, err := queryCounts(statsStatement(query, siteQuery, request.Referer, request.Site))
+		request.Response <- ResultsPerDayResponse{
+			Results: results,
+			Err:     err,
+		}
+	}
+
+	if err := query.Close(); err != nil {
+		log.Printf("error while closing results per day query: %v", err)
+	}
+	if err := siteQuery.Close(); err != nil {
+		log.Printf("error while closing site results per day query: %v", err)
+	}
+}
+
+func (store *sqliteStore) ResultsPerCountryForReferrer(requests <-chan ResultsPerCountryRequest) {
+	query, err := store.db.Prepare("SELECT country, results FROM results_per_country WHERE referer = ? ORDER BY results DESC")
+	if err != nil {
+		log.Fatalf("error preparing result count statement: %v", err)
+	}
+	siteQuery, err := store.db.Prepare("SELECT country, results FROM site_results_per_country WHERE site = ? ORDER BY results DESC")
+	if err != nil {
+		log.Fatalf("error preparing site result count statement: %v", err)
+	}
+
+	for request := range requests {
+		results, err := queryCounts(statsStatement(query, siteQuery, request.Referer, request.Site))
+		request.Response <- ResultsPerCountryResponse{
+			Results: results,
+			Err:     err,
+		}
+	}
+
+	if err := query.Close(); err != nil {
+		log.Printf("error while closing results per country query: %v", err)
+	}
+	if err := siteQuery.Close(); err != nil {
+		log.Printf("error while closing site results per country query: %v", err)
+	}
+}
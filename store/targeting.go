@@ -0,0 +1,209 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var countryNotTargetedCounter = metrics.GetOrRegisterCounter("CountryNotTargeted", nil)
+var countryQuotaExhaustedCounter = metrics.GetOrRegisterCounter("CountryQuotaExhausted", nil)
+var deleteExhaustedSchedulesErrorCounter = metrics.GetOrRegisterCounter("DeleteExhaustedSchedulesError", nil)
+var insertCountryQuotasErrorCounter = metrics.GetOrRegisterCounter("InsertCountryQuotasError", nil)
+
+// Task functions can target clients by country, as reported in the "country"
+// hint. In the database, include_countries and exclude_countries are comma
+// separated lists of country codes and country_quotas is a comma separated
+// list of country:measurements pairs, e.g. "IR:500,CN:500". Each schedule of
+// the function gets its own quotas, in scheduled_country_quotas.
+//
+// A client whose country isn't in a non-empty include list, or is in the
+// exclude list, never gets the task function. A country with a quota stops
+// getting it once the quota is used up. Countries without a quota are only
+// limited by max_measurements.
+
+func normalizeCountry(country string) string {
+	return strings.ToUpper(strings.TrimSpace(country))
+}
+
+func normalizeCountries(countries []string) []string {
+	var normalized []string
+	for _, country := range countries {
+		if country = normalizeCountry(country); country != "" {
+			normalized = append(normalized, country)
+		}
+	}
+	return normalized
+}
+
+func parseCountries(countries string) []string {
+	return normalizeCountries(strings.Split(countries, ","))
+}
+
+func formatCountries(countries []string) string {
+	return strings.Join(normalizeCountries(countries), ",")
+}
+
+func parseCountryQuotas(quotas string) (map[string]int, error) {
+	parsed := make(map[string]int)
+	for _, quota := range strings.Split(quotas, ",") {
+		if strings.TrimSpace(quota) == "" {
+			continue
+		}
+		fields := strings.Split(quota, ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed country quota %q", quota)
+		}
+		measurements, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("malformed country quota %q: %v", quota, err)
+		}
+		parsed[normalizeCountry(fields[0])] = measurements
+	}
+	return parsed, nil
+}
+
+func formatCountryQuotas(quotas map[string]int) string {
+	var formatted []string
+	for country, measurements := range quotas {
+		formatted = append(formatted, fmt.Sprintf("%s:%d", normalizeCountry(country), measurements))
+	}
+	sort.Strings(formatted)
+	return strings.Join(formatted, ",")
+}
+
+func containsCountry(countries []string, country string) bool {
+	for _, c := range countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+// targetsCountry reports whether include and exclude lists admit a client
+// from country.
+func targetsCountry(include, exclude []string, country string) bool {
+	country = normalizeCountry(country)
+	if len(include) > 0 && !containsCountry(include, country) {
+		return false
+	}
+	return !containsCountry(exclude, country)
+}
+
+// quotasExhausted reports whether a schedule can no longer serve anyone
+// because every country it includes has used up its quota.
+func quotasExhausted(include []string, remaining map[string]int64) bool {
+	if len(include) == 0 {
+		return false
+	}
+	for _, country := range include {
+		measurements, ok := remaining[country]
+		if !ok || measurements > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteExhaustedSchedules frees the slots of schedules whose country quotas
+// are all used up, along with quotas of schedules that no longer exist.
+func deleteExhaustedSchedules(tx *sql.Tx, dialect string) error {
+	rows, err := tx.Query("SELECT scheduled_functions.id, coalesce(include_countries, ''), country, scheduled_country_quotas.measurements_remaining FROM scheduled_functions JOIN task_functions ON scheduled_functions.task_function = task_functions.id JOIN scheduled_country_quotas ON scheduled_country_quotas.scheduled_function = scheduled_functions.id")
+	if err != nil {
+		log.Printf("error selecting country quotas: %v", err)
+		deleteExhaustedSchedulesErrorCounter.Inc(1)
+		return err
+	}
+	includes := make(map[int][]string)
+	remaining := make(map[int]map[string]int64)
+	for rows.Next() {
+		var scheduleId int
+		var include, country string
+		var measurements int64
+		if err := rows.Scan(&scheduleId, &include, &country, &measurements); err != nil {
+			rows.Close()
+			log.Printf("error scanning country quota: %v", err)
+			deleteExhaustedSchedulesErrorCounter.Inc(1)
+			return err
+		}
+		includes[scheduleId] = parseCountries(include)
+		if remaining[scheduleId] == nil {
+			remaining[scheduleId] = make(map[string]int64)
+		}
+		remaining[scheduleId][country] = measurements
+	}
+	if err := rows.Close(); err != nil {
+		log.Printf("error closing rows after selecting country quotas: %v", err)
+	}
+
+	for scheduleId, include := range includes {
+		if !quotasExhausted(include, remaining[scheduleId]) {
+			continue
+		}
+		if _, err := tx.Exec(rebind(dialect, "DELETE FROM scheduled_country_quotas WHERE scheduled_function = $1"), scheduleId); err != nil {
+			log.Printf("error deleting exhausted schedule: %v", err)
+			deleteExhaustedSchedulesErrorCounter.Inc(1)
+			return err
+		}
+		if _, err := tx.Exec(rebind(dialect, "DELETE FROM scheduled_functions WHERE id = $1"), scheduleId); err != nil {
+			log.Printf("error deleting exhausted schedule: %v", err)
+			deleteExhaustedSchedulesErrorCounter.Inc(1)
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM scheduled_country_quotas WHERE NOT EXISTS (SELECT NULL FROM scheduled_functions WHERE id = scheduled_function)"); err != nil {
+		log.Printf("error deleting orphaned country quotas: %v", err)
+		deleteExhaustedSchedulesErrorCounter.Inc(1)
+		return err
+	}
+	return nil
+}
+
+// insertCountryQuotas gives newly inserted schedules their country quotas.
+func insertCountryQuotas(tx *sql.Tx, dialect string) error {
+	rows, err := tx.Query("SELECT scheduled_functions.id, country_quotas FROM scheduled_functions JOIN task_functions ON scheduled_functions.task_function = task_functions.id WHERE coalesce(country_quotas, '') <> '' AND NOT EXISTS (SELECT NULL FROM scheduled_country_quotas WHERE scheduled_function = scheduled_functions.id)")
+	if err != nil {
+		log.Printf("error selecting new schedules: %v", err)
+		insertCountryQuotasErrorCounter.Inc(1)
+		return err
+	}
+	quotas := make(map[int]map[string]int)
+	for rows.Next() {
+		var scheduleId int
+		var countryQuotas string
+		if err := rows.Scan(&scheduleId, &countryQuotas); err != nil {
+			rows.Close()
+			log.Printf("error scanning new schedule: %v", err)
+			insertCountryQuotasErrorCounter.Inc(1)
+			return err
+		}
+		parsed, err := parseCountryQuotas(countryQuotas)
+		if err != nil {
+			log.Printf("ignoring country quotas of schedule %d: %v", scheduleId, err)
+			insertCountryQuotasErrorCounter.Inc(1)
+			continue
+		}
+		quotas[scheduleId] = parsed
+	}
+	if err := rows.Close(); err != nil {
+		log.Printf("error closing rows after selecting new schedules: %v", err)
+	}
+
+	for scheduleId, countryQuotas := range quotas {
+		for country, measurements := range countryQuotas {
+			if _, err := tx.Exec(rebind(dialect, "INSERT INTO scheduled_country_quotas (scheduled_function, country, measurements_remaining) VALUES ($1, $2, $3)"), scheduleId, country, measurements); err != nil {
+				log.Printf("error inserting country quota: %v", err)
+				insertCountryQuotasErrorCounter.Inc(1)
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"sync"
+)
+
+// A TaskFilter stands in for a function in the task_functions schema on
+// backends that can't run PL/pgSQL. It reports whether a task may be served
+// to a client with the given hints. This is the only registry of task
+// functions written in Go; Postgres always calls the SQL functions.
+type TaskFilter func(task *Task, hints map[string]string) bool
+
+var taskFiltersMutex sync.RWMutex
+var taskFilters = map[string]TaskFilter{
+	"all_tasks": func(task *Task, hints map[string]string) bool {
+		return true
+	},
+}
+
+// RegisterTaskFilter makes a TaskFilter available under the name used in the
+// task_function column of task_functions.
+func RegisterTaskFilter(name string, filter TaskFilter) {
+	taskFiltersMutex.Lock()
+	defer taskFiltersMutex.Unlock()
+	taskFilters[NormalizeTaskFunctionName(name)] = filter
+}
+
+func lookupTaskFilter(name string) (TaskFilter, bool) {
+	taskFiltersMutex.RLock()
+	defer taskFiltersMutex.RUnlock()
+	filter, ok := taskFilters[NormalizeTaskFunctionName(name)]
+	return filter, ok
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// These implement the task function management parts of Store for the SQL
+// backends.
+
+// NormalizeTaskFunctionName folds a task function name to lower case. Names
+// are PostgreSQL identifiers, which fold to lower case unless quoted, and we
+// quote them when calling functions in the task_functions schema, so every
+// store keeps them in lower case.
+func NormalizeTaskFunctionName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func nullIfZero(value int) sql.NullInt64 {
+	return sql.NullInt64{
+		Int64: int64(value),
+		Valid: value != 0,
+	}
+}
+
+func selectTaskFunctions(db *sql.DB) ([]TaskFunction, error) {
+	rows, err := db.Query("SELECT id, coalesce(priority, 0), coalesce(max_duration_seconds, 0), coalesce(max_measurements, 0), coalesce(max_rate_per_second, 0), coalesce(weight, 1), task_function, coalesce(enabled, false), coalesce(include_countries, ''), coalesce(exclude_countries, ''), coalesce(country_quotas, '') FROM task_functions ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var taskFunctions []TaskFunction
+	for rows.Next() {
+		var taskFunction TaskFunction
+		var include, exclude, quotas string
+		if err := rows.Scan(&taskFunction.Id, &taskFunction.Priority, &taskFunction.MaxDurationSeconds, &taskFunction.MaxMeasurements, &taskFunction.MaxRatePerSecond, &taskFunction.Weight, &taskFunction.Name, &taskFunction.Enabled, &include, &exclude, &quotas); err != nil {
+			return nil, err
+		}
+		taskFunction.IncludeCountries = parseCountries(include)
+		taskFunction.ExcludeCountries = parseCountries(exclude)
+		if taskFunction.CountryQuotas, err = parseCountryQuotas(quotas); err != nil {
+			return nil, fmt.Errorf("task function %d: %v", taskFunction.Id, err)
+		}
+		taskFunctions = append(taskFunctions, taskFunction)
+	}
+	return taskFunctions, rows.Err()
+}
+
+func insertTaskFunction(db *sql.DB, dialect string, taskFunction TaskFunction) (int, error) {
+	var id int
+	row := db.QueryRow(rebind(dialect, "INSERT INTO task_functions (priority, max_duration_seconds, max_measurements, max_rate_per_second, weight, task_function, enabled, include_countries, exclude_countries, country_quotas) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id"),
+		taskFunction.Priority,
+		nullIfZero(taskFunction.MaxDurationSeconds),
+		nullIfZero(taskFunction.MaxMeasurements),
+		nullIfZero(taskFunction.MaxRatePerSecond),
+		taskFunction.Weight,
+		NormalizeTaskFunctionName(taskFunction.Name),
+		taskFunction.Enabled,
+		formatCountries(taskFunction.IncludeCountries),
+		formatCountries(taskFunction.ExcludeCountries),
+		formatCountryQuotas(taskFunction.CountryQuotas))
+	if err := row.Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func updateTaskFunction(db *sql.DB, dialect string, taskFunction TaskFunction) error {
+	result, err := db.Exec(rebind(dialect, "UPDATE task_functions SET priority = $1, max_duration_seconds = $2, max_measurements = $3, max_rate_per_second = $4, weight = $5, task_function = $6, enabled = $7, include_countries = $8, exclude_countries = $9, country_quotas = $10 WHERE id = $11"),
+		taskFunction.Priority,
+		nullIfZero(taskFunction.MaxDurationSeconds),
+		nullIfZero(taskFunction.MaxMeasurements),
+		nullIfZero(taskFunction.MaxRatePerSecond),
+		taskFunction.Weight,
+		NormalizeTaskFunctionName(taskFunction.Name),
+		taskFunction.Enabled,
+		formatCountries(taskFunction.IncludeCountries),
+		formatCountries(taskFunction.ExcludeCountries),
+		formatCountryQuotas(taskFunction.CountryQuotas),
+		taskFunction.Id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func selectConcurrentFunctions(db *sql.DB) (int, error) {
+	var concurrentFunctions int
+	if err := db.QueryRow("SELECT concurrent_functions FROM scheduler_configuration").Scan(&concurrentFunctions); err != nil {
+		return 0, err
+	}
+	return concurrentFunctions, nil
+}
+
+func updateConcurrentFunctions(db *sql.DB, dialect string, concurrentFunctions int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(rebind(dialect, "UPDATE scheduler_configuration SET concurrent_functions = $1"), concurrentFunctions)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rowsAffected == 0 {
+		if _, err := tx.Exec(rebind(dialect, "INSERT INTO scheduler_configuration (concurrent_functions) VALUES ($1)"), concurrentFunctions); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// scheduleTime converts scheduler timestamps, which Postgres stores as
+// timestamps and SQLite as Unix seconds.
+func scheduleTime(value interface{}) time.Time {
+	switch t := value.(type) {
+	case time.Time:
+		return t
+	case int64:
+		return time.Unix(t, 0)
+	default:
+		return time.Time{}
+	}
+}
+
+func selectSchedules(db *sql.DB) ([]Schedule, error) {
+	rows, err := db.Query("SELECT scheduled_functions.id, task_functions.id, task_functions.task_function, coalesce(scheduled_functions.priority, 0), scheduled_time, expiration_time, measurements_remaining FROM scheduled_functions JOIN task_functions ON scheduled_functions.task_function = task_functions.id ORDER BY scheduled_functions.id")
+	if err != nil {
+		return nil, err
+	}
+	var schedules []Schedule
+	indices := make(map[int]int)
+	for rows.Next() {
+		var schedule Schedule
+		var scheduledTime, expirationTime interface{}
+		var measurementsRemaining sql.NullInt64
+		if err := rows.Scan(&schedule.Id, &schedule.TaskFunction, &schedule.TaskFunctionName, &schedule.Priority, &scheduledTime, &expirationTime, &measurementsRemaining); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		schedule.ScheduledTime = scheduleTime(scheduledTime)
+		schedule.ExpirationTime = scheduleTime(expirationTime)
+		if measurementsRemaining.Valid {
+			schedule.MeasurementsRemaining = &measurementsRemaining.Int64
+		}
+		schedule.CountryRemaining = make(map[string]int64)
+		indices[schedule.Id] = len(schedules)
+		schedules = append(schedules, schedule)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT scheduled_function, country, measurements_remaining FROM scheduled_country_quotas")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scheduleId int
+		var country string
+		var remaining int64
+		if err := rows.Scan(&scheduleId, &country, &remaining); err != nil {
+			return nil, err
+		}
+		if idx, ok := indices[scheduleId]; ok {
+			schedules[idx].CountryRemaining[country] = remaining
+		}
+	}
+	return schedules, rows.Err()
+}
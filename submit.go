@@ -2,27 +2,34 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
+	"github.com/sburnett/encore/clientip"
 	"github.com/sburnett/encore/store"
 )
 
 type submitState struct {
-	results chan *store.Result
+	results   chan *store.Result
+	signer    *measurementIdSigner
+	clientIps *clientip.Resolver
 }
 
 var submissionCount = metrics.GetOrRegisterCounter("ResultsSubmitted", nil)
 var submissionErrorCount = metrics.GetOrRegisterCounter("ResultSubmissionRequestsMalformed", nil)
+var unauthenticatedSubmissionCount = metrics.GetOrRegisterCounter("ResultsUnauthenticated", nil)
 
-func NewSubmissionServer(s store.Store) *submitState {
+func NewSubmissionServer(s store.Store, signer *measurementIdSigner, clientIps *clientip.Resolver) *submitState {
 	resultsChan := make(chan *store.Result)
 	go s.WriteResults(resultsChan)
 
 	return &submitState{
-		results: resultsChan,
+		results:   resultsChan,
+		signer:    signer,
+		clientIps: clientIps,
 	}
 }
 
@@ -40,13 +47,21 @@ func (state *submitState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		submissionErrorCount.Inc(1)
 		return
 	}
-	log.Printf("inserting new result from '%v'", r.RemoteAddr)
+	log.Printf("inserting new result from '%v'", state.clientIps.RequestClientIp(r))
+
+	// We record results with bad measurement ids so we can study them, but
+	// they don't count toward anything.
+	authenticated := state.signer.verify(r.URL.Query().Get("cmh-id"))
+	if !authenticated {
+		unauthenticatedSubmissionCount.Inc(1)
+	}
 
 	w.WriteHeader(http.StatusOK)
 
 	state.results <- &store.Result{
-		Timestamp:  time.Now(),
-		RemoteAddr: r.RemoteAddr,
-		RawRequest: rawRequest.Bytes(),
+		Timestamp:     time.Now(),
+		RemoteAddr:    r.RemoteAddr,
+		RawRequest:    rawRequest.Bytes(),
+		Authenticated: sql.NullBool{Bool: authenticated, Valid: true},
 	}
 }
@@ -0,0 +1,45 @@
+{{template "header.vanilla.js" .}}
+CensorshipMeter.measure = function() {
+  var expRef = document.createElement('span');
+  expRef.id = '{{.cssId}}';
+  document.documentElement.appendChild(expRef);
+
+  {{if .controlCssId}}
+  var controlRef = document.createElement('span');
+  controlRef.id = '{{.controlCssId}}';
+  document.documentElement.appendChild(controlRef);
+  {{end}}
+
+  // A stylesheet that fails to load still fires a callback, and the style
+  // check then reports the failure.
+  var checkStyle = function() {
+    try {
+      var style = window.getComputedStyle(expRef);
+      var positionStyle = style.getPropertyValue('{{.cssAttribute}}');
+      if (positionStyle == '{{.cssDesiredValue}}') {
+        CensorshipMeter.sendSuccess();
+      } else {
+        CensorshipMeter.sendFailure();
+      }
+
+      {{if .controlCssId}}
+      var controlStyle = window.getComputedStyle(controlRef);
+      var controlPositionStyle = controlStyle.getPropertyValue('{{.cssAttribute}}');
+      if (controlPositionStyle != '{{.cssDesiredValue}}') {
+        CensorshipMeter.submitResult('success-control');
+      } else {
+        CensorshipMeter.submitResult('failure-control');
+      }
+      {{end}}
+    } catch(err) {
+      CensorshipMeter.sendException(err);
+    }
+  };
+  var link = document.createElement('link');
+  link.rel = 'stylesheet';
+  link.onload = checkStyle;
+  link.onerror = checkStyle;
+  link.href = '{{.cssUrl}}';
+  document.getElementsByTagName('head')[0].appendChild(link);
+}
+{{template "footer.vanilla.js" .}}
@@ -0,0 +1,86 @@
+CensorshipMeter.measure = function() {
+  if (typeof fetch == "undefined") {
+    CensorshipMeter.submitResult("unsupported");
+    return;
+  }
+  // Resource Timing names entries by absolute URL.
+  var link = document.createElement("a");
+  link.href = "{{.fetchUrl}}";
+  var url = link.href;
+  var startTime = Date.now();
+  var report = function(state, message) {
+    var duration = Date.now() - startTime;
+    CensorshipMeter.whenTimed(url, function() {
+      try {
+        CensorshipMeter.submitResult(state, message, CensorshipMeter.resourceTiming(url, duration));
+      } catch(err) {
+        CensorshipMeter.sendException(err);
+      }
+    });
+  };
+  // no-cors lets us reach any origin but hides the response, so we only learn
+  // whether the request completed.
+  fetch(url, {mode: "no-cors", credentials: "omit", cache: "no-store"}).then(function() {
+    report("success");
+  }, function(err) {
+    report("failure", err);
+  });
+}
+// whenTimed calls callback once there is a Resource Timing entry for url, or
+// after a second if none shows up. Browsers can add the entry after fetch
+// resolves.
+CensorshipMeter.whenTimed = function(url, callback) {
+  var called = false;
+  var observer = null;
+  var done = function() {
+    if (called) {
+      return;
+    }
+    called = true;
+    if (observer) {
+      observer.disconnect();
+    }
+    callback();
+  };
+  if (typeof performance == "undefined" || !performance.getEntriesByName || performance.getEntriesByName(url).length > 0) {
+    done();
+    return;
+  }
+  if (typeof PerformanceObserver != "undefined") {
+    observer = new PerformanceObserver(function(list) {
+      if (list.getEntriesByName(url).length > 0) {
+        done();
+      }
+    });
+    observer.observe({entryTypes: ["resource"]});
+  }
+  setTimeout(done, 1000);
+}
+// resourceTiming returns the cmh-timing parameters for the last request to
+// url, falling back to duration when there is no timing entry. Cross-origin
+// targets only expose phases with Timing-Allow-Origin, so we always report the
+// duration but the phases only when requestStart is set.
+CensorshipMeter.resourceTiming = function(url, duration) {
+  var timing = {
+    "cmh-timing-duration": duration,
+  };
+  if (typeof performance == "undefined" || !performance.getEntriesByName) {
+    return timing;
+  }
+  var entries = performance.getEntriesByName(url);
+  if (entries.length == 0) {
+    return timing;
+  }
+  var entry = entries[entries.length - 1];
+  timing["cmh-timing-duration"] = Math.round(entry.duration);
+  if (entry.requestStart > 0) {
+    timing["cmh-timing-dns"] = Math.round(entry.domainLookupEnd - entry.domainLookupStart);
+    timing["cmh-timing-connect"] = Math.round(entry.connectEnd - entry.connectStart);
+    if (entry.secureConnectionStart > 0) {
+      timing["cmh-timing-tls"] = Math.round(entry.connectEnd - entry.secureConnectionStart);
+    }
+    timing["cmh-timing-request"] = Math.round(entry.responseStart - entry.requestStart);
+    timing["cmh-timing-response"] = Math.round(entry.responseEnd - entry.responseStart);
+  }
+  return timing;
+}
@@ -0,0 +1,3 @@
+{{template "header.js" .}}
+{{template "fetch-body.js" .}}
+{{template "footer.js" .}}
@@ -0,0 +1,3 @@
+{{template "header.vanilla.js" .}}
+{{template "fetch-body.js" .}}
+{{template "footer.vanilla.js" .}}
@@ -0,0 +1 @@
+CensorshipMeter.run();
@@ -2,7 +2,9 @@ var CensorshipMeter = new Object();
 CensorshipMeter.baseUrl = "{{.serverUrl}}/submit";
 CensorshipMeter.measurementId = encodeURIComponent("{{.measurementId}}");
 CensorshipMeter.maxMessageLength = 64;
-CensorshipMeter.submitResult = function(state, message) {
+// Tasks can't replace these with extra parameters.
+CensorshipMeter.reservedParams = {"cmh-id": true, "cmh-result": true, "cmh-message": true};
+CensorshipMeter.submitResult = function(state, message, extra) {
   this.submitted = state;
   var params = {
     "cmh-id": this.measurementId,
@@ -11,6 +13,13 @@ CensorshipMeter.submitResult = function(state, message) {
   if (message != null) {
     params["cmh-message"] = String(message).substring(0, this.maxMessageLength);
   }
+  if (extra != null) {
+    $.each(extra, function(key, value) {
+      if (!CensorshipMeter.reservedParams.hasOwnProperty(key)) {
+        params[key] = value;
+      }
+    });
+  }
   $.ajax({
     url: this.baseUrl + "?" + $.param(params),
   });
@@ -31,11 +40,11 @@ CensorshipMeter.setupStats = function() {
     return;
   }
   {{if eq .count "0"}}
-  this.logo.html('Visitors of this page automatically measure Web filtering. <a href="{{.serverUrl}}/stats/refer">Learn more</a>.');
+  this.logo.html('Visitors of this page automatically measure Web filtering. <a href="{{.statsUrl}}">Learn more</a>.');
   {{else if eq .count "1"}}
-  this.logo.html('Visitors of this page have performed {{.count}} measurement of Web filtering. <a href="{{.serverUrl}}/stats/refer">Learn more</a>.');
+  this.logo.html('Visitors of this page have performed {{.count}} measurement of Web filtering. <a href="{{.statsUrl}}">Learn more</a>.');
   {{else}}
-  this.logo.html('Visitors of this page have performed {{.count}} measurements of Web filtering. <a href="{{.serverUrl}}/stats/refer">Learn more</a>.');
+  this.logo.html('Visitors of this page have performed {{.count}} measurements of Web filtering. <a href="{{.statsUrl}}">Learn more</a>.');
   {{end}}
 }
 {{end}}
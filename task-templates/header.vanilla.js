@@ -0,0 +1,94 @@
+var CensorshipMeter = new Object();
+CensorshipMeter.baseUrl = "{{.serverUrl}}/submit";
+CensorshipMeter.measurementId = encodeURIComponent("{{.measurementId}}");
+CensorshipMeter.maxMessageLength = 64;
+CensorshipMeter.nonce = "{{.nonce}}";
+// Tasks can't replace these with extra parameters.
+CensorshipMeter.reservedParams = {"cmh-id": true, "cmh-result": true, "cmh-message": true};
+CensorshipMeter.submitResult = function(state, message, extra) {
+  this.submitted = state;
+  var url = this.baseUrl + "?cmh-id=" + this.measurementId + "&cmh-result=" + encodeURIComponent(state);
+  if (message != null) {
+    url += "&cmh-message=" + encodeURIComponent(String(message).substring(0, this.maxMessageLength));
+  }
+  if (extra != null) {
+    for (var key in extra) {
+      if (extra.hasOwnProperty(key) && !this.reservedParams.hasOwnProperty(key)) {
+        url += "&" + encodeURIComponent(key) + "=" + encodeURIComponent(extra[key]);
+      }
+    }
+  }
+  if (navigator.sendBeacon) {
+    try {
+      if (navigator.sendBeacon(url)) {
+        return;
+      }
+    } catch(err) {
+    }
+  }
+  if (window.fetch) {
+    fetch(url, {mode: "no-cors", credentials: "omit", keepalive: true});
+    return;
+  }
+  var request = new XMLHttpRequest();
+  request.open("GET", url);
+  request.send();
+}
+CensorshipMeter.sendSuccess = function() {
+  this.submitResult("success");
+}
+CensorshipMeter.sendFailure = function() {
+  this.submitResult("failure");
+}
+CensorshipMeter.sendException = function(err) {
+  this.submitResult("exception", err);
+}
+CensorshipMeter.ready = function(callback) {
+  if (document.readyState == "loading") {
+    document.addEventListener("DOMContentLoaded", callback);
+  } else {
+    callback();
+  }
+}
+CensorshipMeter.appendHidden = function(element) {
+  element.style.display = "none";
+  document.documentElement.appendChild(element);
+}
+{{if ne .hintShowStats "false"}}
+CensorshipMeter.setupStats = function() {
+  this.logo = document.getElementById("encore-stats");
+  if (this.logo == null) {
+    return;
+  }
+  // Build the message from nodes, so pages that require Trusted Types
+  // accept it.
+  {{if eq .count "0"}}
+  var text = 'Visitors of this page automatically measure Web filtering. ';
+  {{else if eq .count "1"}}
+  var text = 'Visitors of this page have performed {{.count}} measurement of Web filtering. ';
+  {{else}}
+  var text = 'Visitors of this page have performed {{.count}} measurements of Web filtering. ';
+  {{end}}
+  var link = document.createElement('a');
+  link.href = '{{.statsUrl}}';
+  link.appendChild(document.createTextNode('Learn more'));
+  this.logo.appendChild(document.createTextNode(text));
+  this.logo.appendChild(link);
+  this.logo.appendChild(document.createTextNode('.'));
+}
+{{end}}
+CensorshipMeter.run = function() {
+  this.submitResult("init");
+  this.ready(function() {
+    try {
+      CensorshipMeter.measure();
+    } catch(err) {
+      CensorshipMeter.sendException(err);
+    }
+  });
+{{if ne .hintShowStats "false"}}
+  this.ready(function() {
+    CensorshipMeter.setupStats();
+  });
+{{end}}
+}
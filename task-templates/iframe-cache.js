@@ -22,7 +22,7 @@ CensorshipMeter.measure = function() {
         }
       });
       img.on('error', function() {
-        CensorshipMeter.sendError();
+        CensorshipMeter.sendFailure();
       });
 
       {{if .controlImageUrl}}
@@ -0,0 +1,54 @@
+{{template "header.vanilla.js" .}}
+CensorshipMeter.measure = function() {
+  var iframe = document.createElement('iframe');
+  iframe.width = 0;
+  iframe.height = 0;
+  iframe.onload = function() {
+    try {
+      var iframeEndTime = Date.now();
+      CensorshipMeter.submitResult('load-time-iframe', iframeEndTime - CensorshipMeter.iframeStartTime);
+
+      var img = document.createElement('img');
+      img.src = '{{.imageUrl}}';
+      img.onload = function() {
+        try {
+          var imgEndTime = Date.now();
+          CensorshipMeter.submitResult('load-time-img', imgEndTime - CensorshipMeter.imgStartTime);
+        } catch(err) {
+          CensorshipMeter.sendException(err);
+        }
+      };
+      img.onerror = function() {
+        CensorshipMeter.sendFailure();
+      };
+
+      {{if .controlImageUrl}}
+      var controlImg = document.createElement('img');
+      controlImg.src = '{{.controlImageUrl}}';
+      controlImg.onload = function() {
+        try {
+          var controlImgEndTime = Date.now();
+          CensorshipMeter.submitResult('load-time-control-img', controlImgEndTime - CensorshipMeter.imgStartTime);
+        } catch(err) {
+          CensorshipMeter.sendException(err);
+        }
+      };
+      controlImg.onerror = function() {
+        CensorshipMeter.submitResult('failure-control');
+      };
+      {{end}}
+
+      CensorshipMeter.imgStartTime = Date.now();
+      CensorshipMeter.appendHidden(img);
+      {{if .controlImageUrl}}
+      CensorshipMeter.appendHidden(controlImg);
+      {{end}}
+    } catch(err) {
+      CensorshipMeter.sendException(err);
+    }
+  };
+  iframe.src = '{{.iframeUrl}}';
+  CensorshipMeter.iframeStartTime = Date.now();
+  CensorshipMeter.appendHidden(iframe);
+}
+{{template "footer.vanilla.js" .}}
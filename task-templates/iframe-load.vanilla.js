@@ -0,0 +1,18 @@
+{{template "header.vanilla.js" .}}
+CensorshipMeter.measure = function() {
+  var iframe = document.createElement('iframe');
+  iframe.width = 0;
+  iframe.height = 0;
+  iframe.onload = function() {
+    try {
+      var endTime = Date.now();
+      CensorshipMeter.submitResult("load-time", endTime - CensorshipMeter.startTime);
+    } catch(err) {
+      CensorshipMeter.sendException(err);
+    }
+  };
+  iframe.src = '{{.iframeUrl}}';
+  CensorshipMeter.startTime = Date.now();
+  CensorshipMeter.appendHidden(iframe);
+}
+{{template "footer.vanilla.js" .}}
@@ -0,0 +1,27 @@
+{{template "header.js" .}}
+// Each of the space separated imageUrls reports under its index as cmh-sub,
+// and the shared control reports under "control".
+// The measurement as a whole never reports success or failure; only these
+// per-sub results are sent.
+CensorshipMeter.measureImage = function(url, subTarget, success, failure) {
+  var img = $('<img />');
+  img.attr('src', url);
+  img.css('display', 'none');
+  img.on('load', function() {
+    CensorshipMeter.submitResult(success, null, {"cmh-sub": subTarget});
+  });
+  img.on('error', function() {
+    CensorshipMeter.submitResult(failure, null, {"cmh-sub": subTarget});
+  });
+  img.appendTo('html');
+}
+CensorshipMeter.measure = function() {
+  var urls = $.trim('{{.imageUrls}}').split(/\s+/);
+  urls.forEach(function(url, i) {
+    CensorshipMeter.measureImage(url, String(i), 'success', 'failure');
+  });
+  {{if .controlImageUrl}}
+  CensorshipMeter.measureImage('{{.controlImageUrl}}', 'control', 'success-control', 'failure-control');
+  {{end}}
+}
+{{template "footer.js" .}}
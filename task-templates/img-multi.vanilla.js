@@ -0,0 +1,26 @@
+{{template "header.vanilla.js" .}}
+// Each of the space separated imageUrls reports under its index as cmh-sub,
+// and the shared control reports under "control".
+// The measurement as a whole never reports success or failure; only these
+// per-sub results are sent.
+CensorshipMeter.measureImage = function(url, subTarget, success, failure) {
+  var img = document.createElement('img');
+  img.onload = function() {
+    CensorshipMeter.submitResult(success, null, {"cmh-sub": subTarget});
+  };
+  img.onerror = function() {
+    CensorshipMeter.submitResult(failure, null, {"cmh-sub": subTarget});
+  };
+  img.src = url;
+  CensorshipMeter.appendHidden(img);
+}
+CensorshipMeter.measure = function() {
+  var urls = '{{.imageUrls}}'.replace(/^\s+|\s+$/g, '').split(/\s+/);
+  urls.forEach(function(url, i) {
+    CensorshipMeter.measureImage(url, String(i), 'success', 'failure');
+  });
+  {{if .controlImageUrl}}
+  CensorshipMeter.measureImage('{{.controlImageUrl}}', 'control', 'success-control', 'failure-control');
+  {{end}}
+}
+{{template "footer.vanilla.js" .}}
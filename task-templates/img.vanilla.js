@@ -0,0 +1,13 @@
+{{template "header.vanilla.js" .}}
+CensorshipMeter.measure = function() {
+  var img = document.createElement('img');
+  img.onload = function() {
+    CensorshipMeter.sendSuccess();
+  };
+  img.onerror = function() {
+    CensorshipMeter.sendFailure();
+  };
+  img.src = '{{.imageUrl}}';
+  CensorshipMeter.appendHidden(img);
+}
+{{template "footer.vanilla.js" .}}
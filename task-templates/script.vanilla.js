@@ -0,0 +1,16 @@
+{{template "header.vanilla.js" .}}
+CensorshipMeter.measure = function() {
+  var script = document.createElement('script');
+  script.onload = function() {
+    CensorshipMeter.sendSuccess();
+  };
+  script.onerror = function() {
+    CensorshipMeter.sendFailure();
+  };
+  if (CensorshipMeter.nonce) {
+    script.nonce = CensorshipMeter.nonce;
+  }
+  script.src = '{{.scriptUrl}}';
+  document.documentElement.appendChild(script);
+}
+{{template "footer.vanilla.js" .}}
@@ -3,30 +3,37 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"bitbucket.org/maxhauser/jsmin"
-	"github.com/abh/geoip"
 	"github.com/rcrowley/go-metrics"
+	"github.com/sburnett/encore/clientip"
+	"github.com/sburnett/encore/geolocation"
 	"github.com/sburnett/encore/store"
+	"github.com/sburnett/encore/tasktemplate"
 )
 
 type measurementsServerState struct {
-	Templates            *template.Template
+	Templates            *tasktemplate.Set
 	Queries              chan *store.Query
+	OptOuts              chan *store.OptOut
 	Store                store.Store
 	TaskRequests         chan *store.TaskRequest
 	MeasurementIds       <-chan string
 	CountResultsRequests chan store.CountResultsRequest
 	ServerUrl            string
-	Geolocator           *geoip.GeoIP
+	Geolocator           geolocation.Geolocator
+	ClientIps            *clientip.Resolver
+	Sites                *siteRegistry
 }
 
 const hintPrefix string = "cmh-"
@@ -34,8 +41,22 @@ const hintPrefix string = "cmh-"
 const (
 	JavaScriptExtension string = ".js"
 	HtmlExtension              = ".html"
+	JsonExtension              = ".json"
 )
 
+// jsonTask is what /task.json returns, for clients that aren't Web pages.
+// They run the task described by TaskType and Parameters and report to
+// SubmitUrl like the JavaScript tasks do, with cmh-id set to MeasurementId,
+// cmh-result set to init, success, failure or exception and an optional
+// cmh-message. Multi-target tasks also set cmh-sub to the target's index, or
+// to control for their control.
+type jsonTask struct {
+	TaskType      string
+	Parameters    map[string]string
+	MeasurementId string
+	SubmitUrl     string
+}
+
 var requestCount = metrics.GetOrRegisterCounter("TasksRequested", nil)
 var optOutCount = metrics.GetOrRegisterCounter("OptOut", nil)
 var noViableTaskCount = metrics.GetOrRegisterCounter("NoViableTask", nil)
@@ -50,12 +71,26 @@ var noRefererCount = metrics.GetOrRegisterCounter("NoReferer", nil)
 var invalidRefererCount = metrics.GetOrRegisterCounter("InvalidReferer", nil)
 var taskFunctionTimeoutCount = metrics.GetOrRegisterCounter("TaskFunctionTimeout", nil)
 var missingTaskTypeCount = metrics.GetOrRegisterCounter("MissingTaskType", nil)
-
-func NewTaskServer(s store.Store, serverUrl, templatesPath, geoipDatabase string) *measurementsServerState {
+var taskValidationProblems = metrics.GetOrRegisterGauge("TaskValidationProblems", nil)
+var templateReloadCount = metrics.GetOrRegisterCounter("TemplateReloads", nil)
+var templateReloadErrorCount = metrics.GetOrRegisterCounter("TemplateReloadError", nil)
+var jsonTaskCount = metrics.GetOrRegisterCounter("JsonTasksServed", nil)
+var jsonTaskErrorCount = metrics.GetOrRegisterCounter("JsonTaskError", nil)
+var unknownSiteKeyCount = metrics.GetOrRegisterCounter("UnknownSiteKey", nil)
+var unregisteredSiteCount = metrics.GetOrRegisterCounter("UnregisteredSiteRefused", nil)
+
+var templatesPollInterval = flag.Duration("task_templates_poll_interval", 10*time.Second, "Reload task templates when they change, checking this often. 0 disables polling; send SIGHUP to reload instead.")
+var honorGpc = flag.Bool("honor_gpc", false, "Treat requests with Sec-GPC: 1 (Global Privacy Control) as opted out.")
+var honorDnt = flag.Bool("honor_dnt", false, "Treat requests with DNT: 1 (Do Not Track) as opted out.")
+
+func NewTaskServer(s store.Store, serverUrl, templatesPath string, geolocator geolocation.Geolocator, signer *measurementIdSigner, clientIps *clientip.Resolver, sites *siteRegistry) *measurementsServerState {
 	queries := make(chan *store.Query)
 	go s.WriteQueries(queries)
 
-	measurementIds := generateMeasurementIds()
+	optOuts := make(chan *store.OptOut)
+	go s.WriteOptOuts(optOuts)
+
+	measurementIds := generateMeasurementIds(signer)
 
 	go s.ScheduleTaskFunctions()
 
@@ -65,21 +100,56 @@ func NewTaskServer(s store.Store, serverUrl, templatesPath, geoipDatabase string
 	countResultsRequests := make(chan store.CountResultsRequest)
 	go s.CountResultsForReferrer(countResultsRequests)
 
-	geolocator, err := geoip.Open(geoipDatabase)
+	templates, err := tasktemplate.NewSet(templatesPath)
 	if err != nil {
-		log.Fatalf("error opening geoip database: %v", err)
+		log.Fatalf("error parsing task templates: %v", err)
 	}
+	validateTasks(s, templates.Templates())
 
-	return &measurementsServerState{
+	state := &measurementsServerState{
 		Store:                s,
-		Templates:            template.Must(template.ParseGlob(filepath.Join(templatesPath, "[a-zA-Z]*"))),
+		Templates:            templates,
 		Queries:              queries,
+		OptOuts:              optOuts,
 		MeasurementIds:       measurementIds,
 		TaskRequests:         taskRequests,
 		CountResultsRequests: countResultsRequests,
 		ServerUrl:            serverUrl,
 		Geolocator:           geolocator,
+		ClientIps:            clientIps,
+		Sites:                sites,
 	}
+	if *templatesPollInterval > 0 {
+		go templates.Watch(*templatesPollInterval, func() {
+			state.ReloadTemplates()
+		})
+	}
+	return state
+}
+
+// ReloadTemplates reparses the task templates. Requests in progress finish
+// with the old templates. If the new templates don't parse, we keep serving
+// the old ones.
+func (state *measurementsServerState) ReloadTemplates() error {
+	if err := state.Templates.Reload(); err != nil {
+		log.Printf("error reloading task templates, keeping the previous ones: %v", err)
+		templateReloadErrorCount.Inc(1)
+		return err
+	}
+	log.Printf("reloaded task templates")
+	templateReloadCount.Inc(1)
+	validateTasks(state.Store, state.Templates.Templates())
+	return nil
+}
+
+// validateTasks reports tasks that would fail to render, so we find out before
+// visitors get errors.
+func validateTasks(s store.Store, templates *template.Template) {
+	problems := tasktemplate.Validate(templates, s.AllTasks())
+	for _, problem := range problems {
+		log.Printf("invalid tasks: %s", problem)
+	}
+	taskValidationProblems.Update(int64(len(problems)))
 }
 
 func parseContentType(path string) string {
@@ -88,6 +158,8 @@ func parseContentType(path string) string {
 		return JavaScriptExtension
 	case ".html", ".htm":
 		return HtmlExtension
+	case ".json":
+		return JsonExtension
 	default:
 		return HtmlExtension
 	}
@@ -136,20 +208,42 @@ func parseHints(r *http.Request) (hints map[string]string) {
 	return
 }
 
-func countResultsForReferer(requests chan store.CountResultsRequest, r *http.Request) (int, error) {
+// requestReferer returns the page that embedded the task, in the form we
+// count results under.
+func requestReferer(r *http.Request) (string, error) {
 	referers, ok := r.Header["Referer"]
 	if !ok {
 		noRefererCount.Inc(1)
-		return 0, fmt.Errorf("no referer")
+		return "", fmt.Errorf("no referer")
 	}
-	referer, err := url.ParseRequestURI(referers[0])
+	return formatReferer(referers[0])
+}
+
+// countResultsForRequest counts results for the site that embedded the task,
+// or for its referer if the site isn't registered.
+func countResultsForRequest(requests chan store.CountResultsRequest, r *http.Request, site store.Site) (int, error) {
+	if site.Id != 0 {
+		return countResults(requests, "", site.Id)
+	}
+	referer, err := requestReferer(r)
 	if err != nil {
-		invalidRefererCount.Inc(1)
-		return 0, fmt.Errorf("invalid referer")
+		return 0, err
 	}
-	referer.RawQuery = "" // Remove query parameters for robustness.
+	return countResults(requests, referer, 0)
+}
 
-	return countResults(requests, referer.String())
+// optOutReason returns why the visitor opted out, or "" if they didn't.
+func optOutReason(r *http.Request, hints map[string]string) string {
+	if disabled, ok := hints["disable"]; ok && disabled == "true" {
+		return "request"
+	}
+	if *honorGpc && r.Header.Get("Sec-GPC") == "1" {
+		return "gpc"
+	}
+	if *honorDnt && r.Header.Get("DNT") == "1" {
+		return "dnt"
+	}
+	return ""
 }
 
 func (state *measurementsServerState) selectTask(hints map[string]string) *store.Task {
@@ -169,6 +263,22 @@ func (state *measurementsServerState) selectTask(hints map[string]string) *store
 	return task
 }
 
+func newJsonTask(task *store.Task, measurementId, serverUrl string) jsonTask {
+	parameters := make(map[string]string)
+	for k, v := range task.Parameters {
+		if !v.Valid || k == "taskType" {
+			continue
+		}
+		parameters[k] = v.String
+	}
+	return jsonTask{
+		TaskType:      task.Parameters["taskType"].String,
+		Parameters:    parameters,
+		MeasurementId: measurementId,
+		SubmitUrl:     serverUrl + "/submit",
+	}
+}
+
 func (state *measurementsServerState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	requestCount.Inc(1)
 	log.Printf("serving %v", r.URL)
@@ -179,22 +289,53 @@ func (state *measurementsServerState) ServeHTTP(w http.ResponseWriter, r *http.R
 		w.Header().Set("Content-Type", "text/html")
 	case JavaScriptExtension:
 		w.Header().Set("Content-Type", "application/javascript")
+	case JsonExtension:
+		w.Header().Set("Content-Type", "application/json")
+		// Browser extensions may fetch tasks from other origins.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
 	}
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 
 	hints := parseHints(r)
 
-	clientIp := r.Header.Get("X-Real-Ip")
-	if clientIp == "" {
-		clientIp = r.RemoteAddr
+	// Always overwrite location hints, so clients can't make them up.
+	location := state.Geolocator.Locate(state.ClientIps.RequestClientIp(r))
+	hints["country"] = location.Country
+	hints["asn"] = ""
+	if location.Asn != 0 {
+		hints["asn"] = strconv.FormatUint(uint64(location.Asn), 10)
 	}
-	hints["country"], _ = state.Geolocator.GetCountry(clientIp)
+	hints["city"] = location.City
 
-	if disabled, ok := hints["disable"]; ok && disabled == "true" {
-		log.Printf("user opted out of Encore")
+	site, registered := state.Sites.Lookup(hints["site"])
+	if hints["site"] != "" && !registered {
+		log.Printf("unknown or disabled site key %q", hints["site"])
+		unknownSiteKeyCount.Inc(1)
+	}
+	// Likewise, only the site decides which task types it allows.
+	hints["taskTypes"] = strings.Join(site.AllowedTaskTypes, ",")
+
+	if reason := optOutReason(r, hints); reason != "" {
+		log.Printf("user opted out of Encore (%s)", reason)
 		w.WriteHeader(http.StatusOK)
 		optOutCount.Inc(1)
+		referer, err := requestReferer(r)
+		if err == nil || registered {
+			state.OptOuts <- &store.OptOut{
+				Timestamp: time.Now(),
+				Referer:   referer,
+				Reason:    reason,
+				Site:      site.Id,
+			}
+		}
+		return
+	}
+
+	if !registered && *requireSiteKey {
+		log.Printf("refusing task to unregistered site")
+		w.WriteHeader(http.StatusForbidden)
+		unregisteredSiteCount.Inc(1)
 		return
 	}
 
@@ -215,7 +356,19 @@ func (state *measurementsServerState) ServeHTTP(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	templateName := taskType.String + substrate
+	// Pages pick a client runtime with the "runtime" hint, or get their
+	// site's. Task types without templates for it use the default runtime.
+	// CSP mode needs the vanilla runtime, which doesn't inject helper scripts.
+	csp := hints["csp"] == "true"
+	runtime := hints["runtime"]
+	if runtime == "" {
+		runtime = site.Runtime
+	}
+	if csp {
+		runtime = "vanilla"
+	}
+	templates := state.Templates.Current()
+	templateName, runtime := tasktemplate.TemplateName(templates.Templates, taskType.String, runtime, substrate)
 
 	// Select task parameters
 	taskParameters := make(map[string]string)
@@ -224,8 +377,18 @@ func (state *measurementsServerState) ServeHTTP(w http.ResponseWriter, r *http.R
 	taskParameters["hintJQueryAlreadyLoaded"] = hints["jQueryAlreadyLoaded"]
 	taskParameters["hintShowStats"] = hints["showStats"]
 	taskParameters["hintCountry"] = hints["country"]
-	if showStats, ok := hints["showStats"]; !ok || showStats != "false" {
-		count, err := countResultsForReferer(state.CountResultsRequests, r)
+	taskParameters["runtime"] = runtime
+	taskParameters["nonce"] = ""
+	taskParameters["statsUrl"] = state.ServerUrl + "/stats/refer"
+	if registered {
+		// Registered sites show statistics only if they opted in.
+		if !site.ShowStats {
+			taskParameters["hintShowStats"] = "false"
+		}
+		taskParameters["statsUrl"] += "?" + url.Values{"site": {site.Key}}.Encode()
+	}
+	if substrate != JsonExtension && taskParameters["hintShowStats"] != "false" {
+		count, err := countResultsForRequest(state.CountResultsRequests, r, site)
 		if err != nil {
 			log.Printf("error counting results: %v", err)
 			countResultsErrorCount.Inc(1)
@@ -238,22 +401,48 @@ func (state *measurementsServerState) ServeHTTP(w http.ResponseWriter, r *http.R
 		}
 		taskParameters[k] = v.String
 	}
-
-	// Execute the template
-	responseBody := bytes.Buffer{}
-	if err := state.Templates.ExecuteTemplate(&responseBody, templateName, taskParameters); err != nil {
-		log.Printf("error executing task template %s: %v", templateName, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		templateExecutionErrorCount.Inc(1)
-		return
+	if csp && substrate == HtmlExtension {
+		// We serve task.html, so it gets our policy and our nonce.
+		nonce, err := newNonce()
+		if err != nil {
+			log.Printf("error generating CSP nonce: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			nonceErrorCount.Inc(1)
+			return
+		}
+		taskParameters["nonce"] = nonce
+		w.Header().Set("Content-Security-Policy", taskCspSources(taskParameters, state.ServerUrl).Policy(nonce))
+		cspPolicyCount.Inc(1)
+	} else if csp && substrate == JavaScriptExtension {
+		taskParameters["nonce"] = pageNonce(hints)
 	}
 
-	if minify, ok := hints["minify"]; ok && minify == "false" {
-		responseBody.WriteTo(w)
-		minifiedCount.Inc(1)
+	// Execute the template, or describe the task in JSON
+	responseBody := bytes.Buffer{}
+	if substrate == JsonExtension {
+		if err := json.NewEncoder(&responseBody).Encode(newJsonTask(task, taskParameters["measurementId"], state.ServerUrl)); err != nil {
+			log.Printf("error encoding JSON task: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			jsonTaskErrorCount.Inc(1)
+			return
+		}
+		w.Write(responseBody.Bytes())
+		jsonTaskCount.Inc(1)
 	} else {
-		jsmin.Run(&responseBody, w)
-		unminifiedCount.Inc(1)
+		if err := templates.Templates.ExecuteTemplate(&responseBody, templateName, taskParameters); err != nil {
+			log.Printf("error executing task template %s: %v", templateName, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			templateExecutionErrorCount.Inc(1)
+			return
+		}
+
+		if minify, ok := hints["minify"]; ok && minify == "false" {
+			responseBody.WriteTo(w)
+			minifiedCount.Inc(1)
+		} else {
+			jsmin.Run(&responseBody, w)
+			unminifiedCount.Inc(1)
+		}
 	}
 
 	var rawRequest bytes.Buffer
@@ -279,6 +468,9 @@ func (state *measurementsServerState) ServeHTTP(w http.ResponseWriter, r *http.R
 		Substrate:      substrate,
 		ParametersJson: parametersBytes,
 		ResponseBody:   responseBody.Bytes(),
+		TemplateHash:   templates.Hashes[templateName],
+		GitRevision:    gitRevisionId,
+		Site:           site.Id,
 	}
 
 	responseCount.Inc(1)
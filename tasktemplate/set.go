@@ -0,0 +1,150 @@
+package tasktemplate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Set holds the parsed templates of a directory and can reparse them while
+// other goroutines render. A reload that fails keeps the previous templates.
+type Set struct {
+	path        string
+	mutex       sync.Mutex
+	templates   atomic.Value
+	fingerprint string
+}
+
+func NewSet(path string) (*Set, error) {
+	set := &Set{
+		path: path,
+	}
+	if err := set.Reload(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// Parsed is one version of the templates of a Set. Hashes identifies the
+// content of each template, including the templates it calls, so that
+// measurements can be traced back to the template that produced them.
+type Parsed struct {
+	Templates *template.Template
+	Hashes    map[string]string
+}
+
+// Current returns the current templates. Callers should use the returned
+// value for a whole request, even if the set is reloaded meanwhile.
+func (set *Set) Current() *Parsed {
+	return set.templates.Load().(*Parsed)
+}
+
+func (set *Set) Templates() *template.Template {
+	return set.Current().Templates
+}
+
+// hash returns a short hash of the source of a template and the templates it
+// calls.
+func hash(templates *template.Template, name string) string {
+	h := sha256.New()
+	visited := make(map[string]bool)
+	var add func(name string)
+	add = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		t := templates.Lookup(name)
+		if t == nil || t.Tree == nil {
+			return
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", name, t.Tree.Root.String())
+		for _, called := range calledTemplates(t.Tree.Root) {
+			add(called)
+		}
+	}
+	add(name)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func newParsed(templates *template.Template) *Parsed {
+	hashes := make(map[string]string)
+	for _, t := range templates.Templates() {
+		hashes[t.Name()] = hash(templates, t.Name())
+	}
+	return &Parsed{
+		Templates: templates,
+		Hashes:    hashes,
+	}
+}
+
+// fingerprint summarizes the names, sizes and modification times of the
+// template files, so we can tell when they change.
+func fingerprint(path string) (string, error) {
+	names, err := filepath.Glob(filepath.Join(path, "[a-zA-Z]*"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+	var entries []string
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, fmt.Sprintf("%s:%d:%d", name, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(entries, "\n"), nil
+}
+
+// Reload parses the templates again and swaps them in if they parse. Files
+// that fail to parse aren't retried by Watch until they change again.
+func (set *Set) Reload() error {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	current, err := fingerprint(set.path)
+	if err != nil {
+		return err
+	}
+	set.fingerprint = current
+	templates, err := Parse(set.path)
+	if err != nil {
+		return err
+	}
+	set.templates.Store(newParsed(templates))
+	return nil
+}
+
+// Changed reports whether the template files changed since they were last
+// parsed.
+func (set *Set) Changed() bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	current, err := fingerprint(set.path)
+	if err != nil {
+		log.Printf("error checking task templates for changes: %v", err)
+		return false
+	}
+	return current != set.fingerprint
+}
+
+// Watch calls reload whenever the template files change, checking every
+// interval. It never returns.
+func (set *Set) Watch(interval time.Duration, reload func()) {
+	for _ = range time.Tick(interval) {
+		if set.Changed() {
+			reload()
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Package tasktemplate checks that tasks and the templates that render them
+// agree.
+package tasktemplate
+
+import (
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template/parse"
+
+	"github.com/sburnett/encore/store"
+)
+
+// Extensions of the templates that every taskType needs, one for each
+// substrate the task server serves.
+var Extensions = []string{".js", ".html"}
+
+// The default client runtime uses jQuery. A task type may also have templates
+// for other Runtimes, named like img.vanilla.js, and falls back to the
+// default templates where it doesn't.
+const DefaultRuntime = "jquery"
+
+var Runtimes = []string{DefaultRuntime, "vanilla"}
+
+// ValidRuntime reports whether runtime is one of Runtimes or empty, which
+// means the default.
+func ValidRuntime(runtime string) bool {
+	if runtime == "" {
+		return true
+	}
+	for _, valid := range Runtimes {
+		if runtime == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// TemplateName returns the template that renders taskType with extension in
+// runtime, and the runtime that template is for.
+func TemplateName(templates *template.Template, taskType, runtime, extension string) (string, string) {
+	if runtime != "" && runtime != DefaultRuntime {
+		name := taskType + "." + runtime + extension
+		if templates.Lookup(name) != nil {
+			return name, runtime
+		}
+	}
+	return taskType + extension, DefaultRuntime
+}
+
+// ServerParameters are the parameters that the task server supplies itself,
+// so tasks needn't.
+var ServerParameters = []string{
+	"serverUrl",
+	"measurementId",
+	"hintJQueryAlreadyLoaded",
+	"hintShowStats",
+	"hintCountry",
+	"statsUrl",
+	"runtime",
+	"nonce",
+	"count",
+}
+
+// Parse parses every template in path, like the task server does.
+func Parse(path string) (*template.Template, error) {
+	return template.ParseGlob(filepath.Join(path, "[a-zA-Z]*"))
+}
+
+// A Problem is a mismatch between tasks and templates.
+type Problem struct {
+	TaskType string
+	Template string
+	// Tasks is the number of tasks affected and Example is one of their ids.
+	Tasks   int
+	Example int
+	Message string
+}
+
+func (problem Problem) String() string {
+	if problem.Template == "" {
+		return fmt.Sprintf("%s (%d tasks, e.g. task %d)", problem.Message, problem.Tasks, problem.Example)
+	}
+	return fmt.Sprintf("%s: %s (%d tasks, e.g. task %d)", problem.Template, problem.Message, problem.Tasks, problem.Example)
+}
+
+// Parameters returns the parameters that a template uses, including in the
+// templates it calls. Parameters that are only used inside {{if .param}} are
+// optional and not included.
+func Parameters(templates *template.Template, name string) ([]string, error) {
+	t := templates.Lookup(name)
+	if t == nil || t.Tree == nil {
+		return nil, fmt.Errorf("no template %s", name)
+	}
+	fields := make(map[string]bool)
+	walker := parametersWalker{
+		templates: templates,
+		fields:    fields,
+		visited:   map[string]bool{name: true},
+	}
+	walker.walk(t.Tree.Root, nil)
+
+	var parameters []string
+	for field := range fields {
+		parameters = append(parameters, field)
+	}
+	sort.Strings(parameters)
+	return parameters, nil
+}
+
+type parametersWalker struct {
+	templates *template.Template
+	fields    map[string]bool
+	visited   map[string]bool
+}
+
+func (walker *parametersWalker) addField(field string, guarded map[string]bool) {
+	if !guarded[field] {
+		walker.fields[field] = true
+	}
+}
+
+// walkPipe collects fields used in a pipeline. Fields used as arguments of
+// functions (like eq) are collected too, because they must exist to compare.
+func (walker *parametersWalker) walkPipe(pipe *parse.PipeNode, guarded map[string]bool) {
+	if pipe == nil {
+		return
+	}
+	for _, command := range pipe.Cmds {
+		for _, arg := range command.Args {
+			switch arg := arg.(type) {
+			case *parse.FieldNode:
+				walker.addField(arg.Ident[0], guarded)
+			case *parse.PipeNode:
+				walker.walkPipe(arg, guarded)
+			}
+		}
+	}
+}
+
+// conditionField returns the field that a condition like {{if .param}}
+// tests, if that's all it does.
+func conditionField(pipe *parse.PipeNode) (string, bool) {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return "", false
+	}
+	field, ok := pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	if !ok || len(field.Ident) != 1 {
+		return "", false
+	}
+	return field.Ident[0], true
+}
+
+func (walker *parametersWalker) walk(node parse.Node, guarded map[string]bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			walker.walk(child, guarded)
+		}
+	case *parse.ActionNode:
+		walker.walkPipe(node.Pipe, guarded)
+	case *parse.IfNode:
+		if field, ok := conditionField(node.Pipe); ok {
+			inner := map[string]bool{field: true}
+			for k := range guarded {
+				inner[k] = true
+			}
+			walker.walk(node.List, inner)
+		} else {
+			walker.walkPipe(node.Pipe, guarded)
+			walker.walk(node.List, guarded)
+		}
+		walker.walk(node.ElseList, guarded)
+	case *parse.RangeNode:
+		// The body of range and with has a different dot, so only the
+		// pipeline refers to task parameters.
+		walker.walkPipe(node.Pipe, guarded)
+	case *parse.WithNode:
+		walker.walkPipe(node.Pipe, guarded)
+	case *parse.TemplateNode:
+		if walker.visited[node.Name] {
+			return
+		}
+		walker.visited[node.Name] = true
+		if t := walker.templates.Lookup(node.Name); t != nil && t.Tree != nil {
+			walker.walk(t.Tree.Root, guarded)
+		}
+	}
+}
+
+// calledTemplates returns the names of the templates that node calls
+// directly, in order.
+func calledTemplates(node parse.Node) []string {
+	var names []string
+	var visit func(node parse.Node)
+	visit = func(node parse.Node) {
+		switch node := node.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+			for _, child := range node.Nodes {
+				visit(child)
+			}
+		case *parse.IfNode:
+			visit(node.List)
+			visit(node.ElseList)
+		case *parse.RangeNode:
+			visit(node.List)
+			visit(node.ElseList)
+		case *parse.WithNode:
+			visit(node.List)
+			visit(node.ElseList)
+		case *parse.TemplateNode:
+			names = append(names, node.Name)
+		}
+	}
+	visit(node)
+	return names
+}
+
+// Validate checks that every taskType in tasks has a template for each of
+// Extensions and that each task supplies the parameters its templates use,
+// including templates for other runtimes where they exist.
+func Validate(templates *template.Template, tasks <-chan *store.Task) []Problem {
+	provided := make(map[string]bool)
+	for _, parameter := range ServerParameters {
+		provided[parameter] = true
+	}
+
+	problems := make(map[string]*Problem)
+	var order []string
+	report := func(taskType, templateName, message string, task *store.Task) {
+		key := strings.Join([]string{taskType, templateName, message}, "\x00")
+		problem, ok := problems[key]
+		if !ok {
+			problem = &Problem{
+				TaskType: taskType,
+				Template: templateName,
+				Example:  task.Id,
+				Message:  message,
+			}
+			problems[key] = problem
+			order = append(order, key)
+		}
+		problem.Tasks++
+	}
+
+	parameters := make(map[string][]string)
+	missingTemplates := make(map[string]bool)
+	for task := range tasks {
+		taskType, ok := task.Parameters["taskType"]
+		if !ok || !taskType.Valid || taskType.String == "" {
+			report("", "", "missing taskType", task)
+			continue
+		}
+		for _, extension := range Extensions {
+			for _, runtime := range Runtimes {
+				name, templateRuntime := TemplateName(templates, taskType.String, runtime, extension)
+				if templateRuntime != runtime {
+					// Falls back to the default runtime, which we check anyway.
+					continue
+				}
+				if _, ok := parameters[name]; !ok && !missingTemplates[name] {
+					used, err := Parameters(templates, name)
+					if err != nil {
+						missingTemplates[name] = true
+					} else {
+						parameters[name] = used
+					}
+				}
+				if missingTemplates[name] {
+					report(taskType.String, name, "no such template", task)
+					continue
+				}
+				for _, parameter := range parameters[name] {
+					if provided[parameter] {
+						continue
+					}
+					if value, ok := task.Parameters[parameter]; !ok || !value.Valid {
+						report(taskType.String, name, fmt.Sprintf("missing parameter %s", parameter), task)
+					}
+				}
+			}
+		}
+	}
+
+	var sorted []Problem
+	for _, key := range order {
+		sorted = append(sorted, *problems[key])
+	}
+	return sorted
+}